@@ -0,0 +1,176 @@
+package objcheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// regionInfo describes a single storage region offered by a provider
+type regionInfo struct {
+	Name        string  `json:"name"`
+	Provider    string  `json:"provider"`
+	DisplayName string  `json:"display_name"`
+	Continent   string  `json:"continent"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+}
+
+// regionCatalog maps region names to their descriptions
+type regionCatalog map[string]regionInfo
+
+// catalogFile is the JSON layout of an externally supplied region catalog
+type catalogFile struct {
+	Regions []regionInfo `json:"regions"`
+}
+
+// catalog holds the regions requests are validated against, loaded in init()
+var catalog = defaultCatalog()
+
+// lookup returns the region with the given name and whether it is in the catalog
+func (rc regionCatalog) lookup(name string) (regionInfo, bool) {
+	ri, ok := rc[name]
+	return ri, ok
+}
+
+// parseCatalog decodes the regions from a catalog file
+func parseCatalog(data []byte) ([]regionInfo, error) {
+	var cf catalogFile
+	if err := json.Unmarshal(data, &cf); err != nil {
+		return nil, fmt.Errorf("Bad region catalog: %v", err.Error())
+	}
+	return cf.Regions, nil
+}
+
+// merge adds regions to the catalog, replacing built-in entries with the same name
+func (rc regionCatalog) merge(regions []regionInfo) error {
+	for _, ri := range regions {
+		if ri.Name == "" {
+			return fmt.Errorf("Bad region catalog: region without a name")
+		}
+		if !services[ri.Provider] {
+			return fmt.Errorf("Bad region catalog: unknown provider %v for %v", ri.Provider, ri.Name)
+		}
+		if ri.DisplayName == "" {
+			ri.DisplayName = ri.Name
+		}
+		rc[ri.Name] = ri
+	}
+
+	return nil
+}
+
+// loadCatalog builds the region catalog from the built-in default plus the regions
+// from the configured catalog file and the configuration itself
+func loadCatalog(cc catalogConfig) (regionCatalog, error) {
+	rc := defaultCatalog()
+
+	if cc.File != "" {
+		data, err := ioutil.ReadFile(cc.File)
+		if err != nil {
+			return nil, fmt.Errorf("Bad region catalog: %v", err.Error())
+		}
+		regions, err := parseCatalog(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := rc.merge(regions); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := rc.merge(cc.Regions); err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+// defaultCatalog returns the built-in catalog of public Google Cloud Storage and AWS S3 regions
+func defaultCatalog() regionCatalog {
+	rc := make(regionCatalog)
+	for _, ri := range builtinRegions {
+		rc[ri.Name] = ri
+	}
+	return rc
+}
+
+var builtinRegions = []regionInfo{
+	// Google Cloud Storage
+	{"africa-south1", "gcs", "Johannesburg", "Africa", -26.20, 28.05},
+	{"asia-east1", "gcs", "Taiwan", "Asia", 24.05, 120.52},
+	{"asia-east2", "gcs", "Hong Kong", "Asia", 22.32, 114.17},
+	{"asia-northeast1", "gcs", "Tokyo", "Asia", 35.68, 139.69},
+	{"asia-northeast2", "gcs", "Osaka", "Asia", 34.69, 135.50},
+	{"asia-northeast3", "gcs", "Seoul", "Asia", 37.57, 126.98},
+	{"asia-south1", "gcs", "Mumbai", "Asia", 19.08, 72.88},
+	{"asia-south2", "gcs", "Delhi", "Asia", 28.70, 77.10},
+	{"asia-southeast1", "gcs", "Singapore", "Asia", 1.35, 103.82},
+	{"asia-southeast2", "gcs", "Jakarta", "Asia", -6.21, 106.85},
+	{"australia-southeast1", "gcs", "Sydney", "Oceania", -33.87, 151.21},
+	{"australia-southeast2", "gcs", "Melbourne", "Oceania", -37.81, 144.96},
+	{"europe-central2", "gcs", "Warsaw", "Europe", 52.23, 21.01},
+	{"europe-north1", "gcs", "Finland", "Europe", 60.57, 27.19},
+	{"europe-north2", "gcs", "Stockholm", "Europe", 59.33, 18.07},
+	{"europe-southwest1", "gcs", "Madrid", "Europe", 40.42, -3.70},
+	{"europe-west1", "gcs", "Belgium", "Europe", 50.45, 3.82},
+	{"europe-west2", "gcs", "London", "Europe", 51.51, -0.13},
+	{"europe-west3", "gcs", "Frankfurt", "Europe", 50.11, 8.68},
+	{"europe-west4", "gcs", "Netherlands", "Europe", 53.44, 6.84},
+	{"europe-west6", "gcs", "Zurich", "Europe", 47.38, 8.54},
+	{"europe-west8", "gcs", "Milan", "Europe", 45.46, 9.19},
+	{"europe-west9", "gcs", "Paris", "Europe", 48.86, 2.35},
+	{"europe-west10", "gcs", "Berlin", "Europe", 52.52, 13.40},
+	{"europe-west12", "gcs", "Turin", "Europe", 45.07, 7.69},
+	{"me-central1", "gcs", "Doha", "Asia", 25.29, 51.53},
+	{"me-central2", "gcs", "Dammam", "Asia", 26.43, 50.10},
+	{"me-west1", "gcs", "Tel Aviv", "Asia", 32.09, 34.78},
+	{"northamerica-northeast1", "gcs", "Montréal", "North America", 45.50, -73.57},
+	{"northamerica-northeast2", "gcs", "Toronto", "North America", 43.65, -79.38},
+	{"northamerica-south1", "gcs", "Querétaro", "North America", 20.59, -100.39},
+	{"southamerica-east1", "gcs", "São Paulo", "South America", -23.55, -46.63},
+	{"southamerica-west1", "gcs", "Santiago", "South America", -33.45, -70.67},
+	{"us-central1", "gcs", "Iowa", "North America", 41.26, -95.86},
+	{"us-east1", "gcs", "South Carolina", "North America", 33.20, -80.01},
+	{"us-east4", "gcs", "Northern Virginia", "North America", 39.04, -77.49},
+	{"us-east5", "gcs", "Columbus", "North America", 39.96, -83.00},
+	{"us-south1", "gcs", "Dallas", "North America", 32.78, -96.80},
+	{"us-west1", "gcs", "Oregon", "North America", 45.59, -121.18},
+	{"us-west2", "gcs", "Los Angeles", "North America", 34.05, -118.24},
+	{"us-west3", "gcs", "Salt Lake City", "North America", 40.76, -111.89},
+	{"us-west4", "gcs", "Las Vegas", "North America", 36.17, -115.14},
+
+	// AWS S3
+	{"af-south-1", "s3", "Cape Town", "Africa", -33.92, 18.42},
+	{"ap-east-1", "s3", "Hong Kong", "Asia", 22.32, 114.17},
+	{"ap-northeast-1", "s3", "Tokyo", "Asia", 35.68, 139.69},
+	{"ap-northeast-2", "s3", "Seoul", "Asia", 37.57, 126.98},
+	{"ap-northeast-3", "s3", "Osaka", "Asia", 34.69, 135.50},
+	{"ap-south-1", "s3", "Mumbai", "Asia", 19.08, 72.88},
+	{"ap-south-2", "s3", "Hyderabad", "Asia", 17.39, 78.49},
+	{"ap-southeast-1", "s3", "Singapore", "Asia", 1.35, 103.82},
+	{"ap-southeast-2", "s3", "Sydney", "Oceania", -33.87, 151.21},
+	{"ap-southeast-3", "s3", "Jakarta", "Asia", -6.21, 106.85},
+	{"ap-southeast-4", "s3", "Melbourne", "Oceania", -37.81, 144.96},
+	{"ap-southeast-5", "s3", "Malaysia", "Asia", 3.14, 101.69},
+	{"ap-southeast-7", "s3", "Thailand", "Asia", 13.76, 100.50},
+	{"ca-central-1", "s3", "Canada Central", "North America", 45.50, -73.57},
+	{"ca-west-1", "s3", "Calgary", "North America", 51.05, -114.07},
+	{"eu-central-1", "s3", "Frankfurt", "Europe", 50.11, 8.68},
+	{"eu-central-2", "s3", "Zurich", "Europe", 47.38, 8.54},
+	{"eu-north-1", "s3", "Stockholm", "Europe", 59.33, 18.07},
+	{"eu-south-1", "s3", "Milan", "Europe", 45.46, 9.19},
+	{"eu-south-2", "s3", "Spain", "Europe", 41.65, -0.88},
+	{"eu-west-1", "s3", "Ireland", "Europe", 53.35, -6.26},
+	{"eu-west-2", "s3", "London", "Europe", 51.51, -0.13},
+	{"eu-west-3", "s3", "Paris", "Europe", 48.86, 2.35},
+	{"il-central-1", "s3", "Tel Aviv", "Asia", 32.09, 34.78},
+	{"me-central-1", "s3", "UAE", "Asia", 24.47, 54.37},
+	{"me-south-1", "s3", "Bahrain", "Asia", 26.07, 50.56},
+	{"mx-central-1", "s3", "Mexico Central", "North America", 20.59, -100.39},
+	{"sa-east-1", "s3", "São Paulo", "South America", -23.55, -46.63},
+	{"us-east-1", "s3", "N. Virginia", "North America", 38.95, -77.45},
+	{"us-east-2", "s3", "Ohio", "North America", 39.96, -83.00},
+	{"us-west-1", "s3", "N. California", "North America", 37.35, -121.96},
+	{"us-west-2", "s3", "Oregon", "North America", 45.59, -121.18},
+}
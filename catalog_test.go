@@ -0,0 +1,64 @@
+package objcheck
+
+import (
+	"testing"
+)
+
+func TestDefaultCatalog(t *testing.T) {
+	rc := defaultCatalog()
+
+	for _, name := range []string{"us-central1", "us-east1", "europe-west2", "asia-east2", "asia-northeast1"} {
+		if ri, ok := rc.lookup(name); !ok || ri.Provider != "gcs" {
+			t.Errorf("Missing gcs region %v", name)
+		}
+	}
+
+	for _, name := range []string{"us-east-1", "us-east-2", "us-west-2", "eu-west-2", "ap-southeast-2"} {
+		if ri, ok := rc.lookup(name); !ok || ri.Provider != "s3" {
+			t.Errorf("Missing s3 region %v", name)
+		}
+	}
+
+	for name, ri := range rc {
+		if ri.DisplayName == "" || ri.Continent == "" {
+			t.Errorf("Incomplete entry for %v", name)
+		}
+	}
+}
+
+func TestCatalogMerge(t *testing.T) {
+	rc := defaultCatalog()
+
+	regions, err := parseCatalog([]byte(`{"regions": [
+		{"name": "us-east-1", "provider": "s3", "display_name": "Virginia", "continent": "North America"},
+		{"name": "moon-base1", "provider": "gcs", "continent": "Moon", "latitude": 0.67, "longitude": 23.47}
+	]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err.Error())
+	}
+
+	err = rc.merge(regions)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err.Error())
+	}
+
+	if ri, _ := rc.lookup("us-east-1"); ri.DisplayName != "Virginia" {
+		t.Errorf("Entry wasn't replaced, display name %v", ri.DisplayName)
+	}
+	if ri, ok := rc.lookup("moon-base1"); !ok || ri.DisplayName != "moon-base1" {
+		t.Errorf("Entry wasn't added %v", ri)
+	}
+	if _, ok := rc.lookup("us-central1"); !ok {
+		t.Error("Built-in entry was dropped")
+	}
+
+	err = rc.merge([]regionInfo{{Name: "mars-1", Provider: "azure"}})
+	if err == nil {
+		t.Error("Missing error for unknown provider")
+	}
+
+	_, err = parseCatalog([]byte(`{"regions": [`))
+	if err == nil {
+		t.Error("Missing error for bad JSON")
+	}
+}
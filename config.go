@@ -0,0 +1,585 @@
+package objcheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+)
+
+// redacted replaces secret values in the effective configuration
+const redacted = "REDACTED"
+
+// config holds the settings for ObjCheck, layered as built-in defaults, then the JSON file
+// named by OBJCHECK_CONFIG, then environment variables, with requests able to override
+// the check defaults and naming
+type config struct {
+	Tracer      tracerConfig            `json:"tracer"`
+	Backends    backendsConfig          `json:"backends"`
+	Credentials credentialsConfig       `json:"credentials"`
+	Limits      limitsConfig            `json:"limits"`
+	Naming      namingConfig            `json:"naming"`
+	Defaults    checkDefaults           `json:"defaults"`
+	Catalog     catalogConfig           `json:"catalog"`
+	Targets     map[string]targetConfig `json:"targets"`
+	Regions     []string                `json:"regions"`
+}
+
+// tracerConfig configures the LightStep tracer, or the X-Ray tracer when a daemon address is
+// set instead, falling back to mocktracer without either
+type tracerConfig struct {
+	AccessToken       string `json:"access_token"`
+	XRayDaemonAddress string `json:"xray_daemon_address"`
+	Version           string `json:"version"`
+	FunctionRegion    string `json:"function_region"`
+	// SamplingRulesFile names an X-Ray sampling rules file deciding which object reads
+	// are traced, see xrayport.NewSampler. Without one every read is traced.
+	SamplingRulesFile string `json:"sampling_rules_file"`
+}
+
+// backendsConfig configures the storage services that can be checked
+type backendsConfig struct {
+	GCS gcsConfig `json:"gcs"`
+	S3  s3Config  `json:"s3"`
+}
+
+type gcsConfig struct {
+	Enabled bool   `json:"enabled"`
+	Scope   string `json:"scope"`
+	clientTracing
+}
+
+type s3Config struct {
+	Enabled   bool `json:"enabled"`
+	DualStack bool `json:"dual_stack"`
+	// SDK is the AWS SDK for Go major version used for S3 fetches, "v1" or "v2"
+	SDK string `json:"sdk"`
+	clientTracing
+}
+
+// clientTracing configures the xrayport tracing of a backend's storage client
+type clientTracing struct {
+	// Propagation lists the trace header formats sent on requests, see xrayport.LookupPropagator
+	Propagation []string `json:"propagation"`
+	// Granularity is how HTTP phases are recorded, see xrayport.ParseGranularity
+	Granularity string `json:"granularity"`
+}
+
+// credentialsConfig holds explicit credentials, each backend uses its SDK's default chain when unset
+type credentialsConfig struct {
+	GCPCredentialsFile string `json:"gcp_credentials_file"`
+	AWSAccessKeyID     string `json:"aws_access_key_id"`
+	AWSSecretAccessKey string `json:"aws_secret_access_key"`
+	AWSSessionToken    string `json:"aws_session_token"`
+}
+
+// limitsConfig bounds what a request can ask for
+type limitsConfig struct {
+	MaxCount int      `json:"max_count"`
+	Pools    []int    `json:"pools"`
+	Sizes    []string `json:"sizes"`
+}
+
+// namingConfig controls how bucket names are built, templates are keyed by service
+type namingConfig struct {
+	BucketPrefix string            `json:"bucket_prefix"`
+	Env          string            `json:"env"`
+	Templates    map[string]string `json:"templates"`
+}
+
+// checkDefaults fill in check parameters a request leaves out
+type checkDefaults struct {
+	Pool          int         `json:"pool"`
+	Count         int         `json:"count"`
+	Size          string      `json:"size"`
+	ObjectTimeout duration    `json:"object_timeout"`
+	Deadline      duration    `json:"deadline"`
+	Retry         retryPolicy `json:"retry"`
+}
+
+// duration is a time.Duration written in JSON as a string such as "1.5s"
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalJSON writes the duration as a string
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads a duration string
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("Bad duration %s: must be a string such as \"5s\"", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("Bad duration %q", s)
+	}
+	*d = duration(v)
+	return nil
+}
+
+// catalogConfig adds regions to the built-in region catalog
+type catalogConfig struct {
+	File    string       `json:"file"`
+	Regions []regionInfo `json:"regions"`
+}
+
+// cfg is the effective configuration, loaded in init()
+var cfg = defaultConfig()
+
+// sampler decides which object reads are traced, loaded in init() from the sampling rules
+// file, nil traces them all
+var sampler *xrayport.Sampler
+
+var prefixPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func defaultClientTracing() clientTracing {
+	return clientTracing{Propagation: []string{"opentracing"}, Granularity: "spans"}
+}
+
+// defaultConfig returns the built-in configuration layer
+func defaultConfig() config {
+	return config{
+		Tracer: tracerConfig{
+			Version: "unknown",
+		},
+		Backends: backendsConfig{
+			GCS: gcsConfig{Enabled: true, Scope: "https://www.googleapis.com/auth/devstorage.full_control", clientTracing: defaultClientTracing()},
+			S3:  s3Config{Enabled: true, DualStack: true, SDK: "v1", clientTracing: defaultClientTracing()},
+		},
+		Limits: limitsConfig{
+			MaxCount: 1000,
+			Pools:    []int{10},
+			Sizes:    []string{"1k"},
+		},
+		Naming: namingConfig{
+			BucketPrefix: "objcheck",
+			Templates: map[string]string{
+				"gcs": defaultBucketTemplate,
+				"s3":  defaultBucketTemplate,
+			},
+		},
+		Defaults: checkDefaults{
+			Size:  "1k",
+			Retry: defaultRetryPolicy(),
+		},
+		Regions: []string{
+			"us-central1", "us-east1", "asia-east2", "europe-west2",
+			"us-east-1", "us-east-2", "us-west-2", "eu-west-2",
+		},
+	}
+}
+
+// loadConfig builds the configuration from defaults, the OBJCHECK_CONFIG file and the
+// environment, and the region catalog it names, which the configured regions must be in
+func loadConfig(lookupEnv func(string) (string, bool)) (config, regionCatalog, error) {
+	c := defaultConfig()
+
+	if filename, ok := lookupEnv("OBJCHECK_CONFIG"); ok && filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return c, nil, fmt.Errorf("Bad config file: %v", err.Error())
+		}
+		if err := json.Unmarshal(data, &c); err != nil {
+			return c, nil, fmt.Errorf("Bad config file %v: %v", filename, err.Error())
+		}
+	}
+
+	if err := c.applyEnv(lookupEnv); err != nil {
+		return c, nil, err
+	}
+
+	if err := c.validate(); err != nil {
+		return c, nil, err
+	}
+
+	rc, err := loadCatalog(c.Catalog)
+	if err != nil {
+		return c, nil, err
+	}
+
+	return c, rc, c.validateRegions(rc)
+}
+
+// applyEnv overrides settings with any that are set in the environment
+func (c *config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	strs := map[string]*string{
+		"LS_ACCESS_TOKEN":                &c.Tracer.AccessToken,
+		"AWS_XRAY_DAEMON_ADDRESS":        &c.Tracer.XRayDaemonAddress,
+		"GIT_TAG":                        &c.Tracer.Version,
+		"FUNCTION_REGION":                &c.Tracer.FunctionRegion,
+		"BUCKET_PREFIX":                  &c.Naming.BucketPrefix,
+		"OBJCHECK_BUCKET_ENV":            &c.Naming.Env,
+		"OBJCHECK_GCS_SCOPE":             &c.Backends.GCS.Scope,
+		"OBJCHECK_GCP_CREDENTIALS_FILE":  &c.Credentials.GCPCredentialsFile,
+		"OBJCHECK_AWS_ACCESS_KEY_ID":     &c.Credentials.AWSAccessKeyID,
+		"OBJCHECK_AWS_SECRET_ACCESS_KEY": &c.Credentials.AWSSecretAccessKey,
+		"OBJCHECK_AWS_SESSION_TOKEN":     &c.Credentials.AWSSessionToken,
+		"OBJCHECK_DEFAULT_SIZE":          &c.Defaults.Size,
+		"REGION_CATALOG_FILE":            &c.Catalog.File,
+		"OBJCHECK_SAMPLING_RULES_FILE":   &c.Tracer.SamplingRulesFile,
+	}
+	for key, dst := range strs {
+		if v, ok := lookupEnv(key); ok && v != "" {
+			*dst = v
+		}
+	}
+
+	ints := map[string]*int{
+		"OBJCHECK_MAX_COUNT":     &c.Limits.MaxCount,
+		"OBJCHECK_DEFAULT_POOL":  &c.Defaults.Pool,
+		"OBJCHECK_DEFAULT_COUNT": &c.Defaults.Count,
+	}
+	for key, dst := range ints {
+		if v, ok := lookupEnv(key); ok && v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("Bad %v: %v", key, v)
+			}
+			*dst = n
+		}
+	}
+
+	for service := range services {
+		key := fmt.Sprintf("OBJCHECK_%v_BUCKET_TEMPLATE", strings.ToUpper(service))
+		if v, ok := lookupEnv(key); ok && v != "" {
+			if c.Naming.Templates == nil {
+				c.Naming.Templates = make(map[string]string)
+			}
+			c.Naming.Templates[service] = v
+		}
+	}
+
+	if v, ok := lookupEnv("OBJCHECK_BACKENDS"); ok && v != "" {
+		c.Backends.GCS.Enabled = false
+		c.Backends.S3.Enabled = false
+		for _, name := range splitList(v) {
+			switch name {
+			case "gcs":
+				c.Backends.GCS.Enabled = true
+			case "s3":
+				c.Backends.S3.Enabled = true
+			default:
+				return fmt.Errorf("Bad OBJCHECK_BACKENDS: unknown service %v", name)
+			}
+		}
+	}
+
+	durations := map[string]*duration{
+		"OBJCHECK_OBJECT_TIMEOUT": &c.Defaults.ObjectTimeout,
+		"OBJCHECK_DEADLINE":       &c.Defaults.Deadline,
+	}
+	for key, dst := range durations {
+		if v, ok := lookupEnv(key); ok && v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("Bad %v: %v", key, v)
+			}
+			*dst = duration(d)
+		}
+	}
+
+	if v, ok := lookupEnv("OBJCHECK_MAX_ATTEMPTS"); ok && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("Bad OBJCHECK_MAX_ATTEMPTS: %v", v)
+		}
+		c.Defaults.Retry.MaxAttempts = n
+	}
+
+	if v, ok := lookupEnv("OBJCHECK_S3_DUAL_STACK"); ok && v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Bad OBJCHECK_S3_DUAL_STACK: %v", v)
+		}
+		c.Backends.S3.DualStack = b
+	}
+
+	if v, ok := lookupEnv("OBJCHECK_S3_SDK"); ok && v != "" {
+		c.Backends.S3.SDK = v
+	}
+
+	tracing := map[string]*clientTracing{
+		"GCS": &c.Backends.GCS.clientTracing,
+		"S3":  &c.Backends.S3.clientTracing,
+	}
+	for service, dst := range tracing {
+		if v, ok := lookupEnv("OBJCHECK_" + service + "_PROPAGATION"); ok && v != "" {
+			dst.Propagation = splitList(v)
+		}
+		if v, ok := lookupEnv("OBJCHECK_" + service + "_GRANULARITY"); ok && v != "" {
+			dst.Granularity = v
+		}
+	}
+
+	if v, ok := lookupEnv("OBJCHECK_POOLS"); ok && v != "" {
+		c.Limits.Pools = nil
+		for _, p := range splitList(v) {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return fmt.Errorf("Bad OBJCHECK_POOLS: %v", v)
+			}
+			c.Limits.Pools = append(c.Limits.Pools, n)
+		}
+	}
+
+	if v, ok := lookupEnv("OBJCHECK_SIZES"); ok && v != "" {
+		c.Limits.Sizes = splitList(v)
+	}
+
+	if v, ok := lookupEnv("OBJCHECK_REGIONS"); ok && v != "" {
+		c.Regions = splitList(v)
+	}
+
+	if v, ok := lookupEnv("REGION_CATALOG"); ok && v != "" {
+		regions, err := parseCatalog([]byte(v))
+		if err != nil {
+			return err
+		}
+		c.Catalog.Regions = append(c.Catalog.Regions, regions...)
+	}
+
+	return nil
+}
+
+// validate checks the configuration is usable, reporting every problem found
+func (c config) validate() error {
+	var ve validationError
+
+	if !prefixPattern.MatchString(c.Naming.BucketPrefix) {
+		ve = append(ve, fieldError{"naming.bucket_prefix", fmt.Sprintf("Bad bucket prefix %q", c.Naming.BucketPrefix)})
+	}
+
+	for service, template := range c.Naming.Templates {
+		if !services[service] {
+			ve = append(ve, fieldError{"naming.templates", fmt.Sprintf("Bad service %v", service)})
+		} else if err := validateTemplate(template); err != nil {
+			ve = append(ve, fieldError{"naming.templates." + service, err.Error()})
+		}
+	}
+
+	for name, t := range c.Targets {
+		field := "targets." + name
+		if name == "" || name == "all" {
+			ve = append(ve, fieldError{field, fmt.Sprintf("Bad target name %q", name)})
+		}
+		if !services[t.Service] {
+			ve = append(ve, fieldError{field + ".service", fmt.Sprintf("Bad service %v", t.Service)})
+		}
+		if t.Region == "" {
+			ve = append(ve, fieldError{field + ".region", "Missing region"})
+		}
+	}
+
+	if c.Tracer.AccessToken != "" && c.Tracer.XRayDaemonAddress != "" {
+		ve = append(ve, fieldError{"tracer", "LightStep access token and X-Ray daemon address can't both be set"})
+	}
+
+	if !c.Backends.GCS.Enabled && !c.Backends.S3.Enabled {
+		ve = append(ve, fieldError{"backends", "No backends enabled"})
+	}
+
+	if c.Backends.GCS.Enabled && c.Backends.GCS.Scope == "" {
+		ve = append(ve, fieldError{"backends.gcs.scope", "Missing GCS scope"})
+	}
+
+	if c.Backends.S3.SDK != "v1" && c.Backends.S3.SDK != "v2" {
+		ve = append(ve, fieldError{"backends.s3.sdk", fmt.Sprintf("Bad AWS SDK version %v", c.Backends.S3.SDK)})
+	}
+
+	ve = append(ve, c.Backends.GCS.clientTracing.validate("backends.gcs.")...)
+	ve = append(ve, c.Backends.S3.clientTracing.validate("backends.s3.")...)
+
+	if (c.Credentials.AWSAccessKeyID == "") != (c.Credentials.AWSSecretAccessKey == "") {
+		ve = append(ve, fieldError{"credentials", "AWS access key ID and secret access key must be set together"})
+	}
+
+	if c.Limits.MaxCount < 1 {
+		ve = append(ve, fieldError{"limits.max_count", fmt.Sprintf("Bad max count %v", c.Limits.MaxCount)})
+	}
+
+	if len(c.Limits.Pools) == 0 {
+		ve = append(ve, fieldError{"limits.pools", "No pools allowed"})
+	}
+	for _, p := range c.Limits.Pools {
+		if p < 2 {
+			ve = append(ve, fieldError{"limits.pools", fmt.Sprintf("Bad pool %v", p)})
+		}
+	}
+
+	if len(c.Limits.Sizes) == 0 {
+		ve = append(ve, fieldError{"limits.sizes", "No sizes allowed"})
+	}
+
+	if c.Defaults.Pool != 0 && !c.poolAllowed(c.Defaults.Pool) {
+		ve = append(ve, fieldError{"defaults.pool", fmt.Sprintf("Default pool %v isn't allowed", c.Defaults.Pool)})
+	}
+
+	if c.Defaults.Count < 0 || c.Defaults.Count > c.Limits.MaxCount {
+		ve = append(ve, fieldError{"defaults.count", fmt.Sprintf("Bad default count %v", c.Defaults.Count)})
+	}
+
+	if c.Defaults.ObjectTimeout < 0 {
+		ve = append(ve, fieldError{"defaults.object_timeout", fmt.Sprintf("Bad object timeout %v", c.Defaults.ObjectTimeout)})
+	}
+
+	if c.Defaults.Deadline < 0 {
+		ve = append(ve, fieldError{"defaults.deadline", fmt.Sprintf("Bad deadline %v", c.Defaults.Deadline)})
+	}
+
+	ve = append(ve, c.Defaults.Retry.validate("defaults.retry.")...)
+
+	if c.Defaults.Size != "" && !c.sizeAllowed(c.Defaults.Size) {
+		ve = append(ve, fieldError{"defaults.size", fmt.Sprintf("Default size %v isn't allowed", c.Defaults.Size)})
+	}
+
+	if len(ve) > 0 {
+		return ve
+	}
+
+	return nil
+}
+
+// validateRegions checks the regions and target regions are in the catalog and offered
+// by their target's service
+func (c config) validateRegions(rc regionCatalog) error {
+	var ve validationError
+
+	for _, region := range c.Regions {
+		if _, ok := rc.lookup(region); !ok {
+			ve = append(ve, fieldError{"regions", fmt.Sprintf("Bad region %v", region)})
+		}
+	}
+
+	for name, t := range c.Targets {
+		field := "targets." + name + ".region"
+		if ri, ok := rc.lookup(t.Region); !ok {
+			ve = append(ve, fieldError{field, fmt.Sprintf("Bad region %v", t.Region)})
+		} else if ri.Provider != t.Service {
+			ve = append(ve, fieldError{field, fmt.Sprintf("Bad service / region combination: %v and %v", t.Service, t.Region)})
+		}
+	}
+
+	if len(ve) > 0 {
+		return ve
+	}
+
+	return nil
+}
+
+// enabled reports whether checks against the service are allowed
+func (c config) enabled(service string) bool {
+	switch service {
+	case "gcs":
+		return c.Backends.GCS.Enabled
+	case "s3":
+		return c.Backends.S3.Enabled
+	}
+	return false
+}
+
+func (c config) poolAllowed(pool int) bool {
+	for _, p := range c.Limits.Pools {
+		if p == pool {
+			return true
+		}
+	}
+	return false
+}
+
+func (c config) sizeAllowed(size string) bool {
+	for _, s := range c.Limits.Sizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// withOverrides returns the configuration with the overrides from a request applied
+func (c config) withOverrides(ocr objCheckRequest) config {
+	if ocr.BucketPrefix != "" {
+		c.Naming.BucketPrefix = ocr.BucketPrefix
+	}
+	return c
+}
+
+// redacted returns a copy of the configuration with secrets masked for display, the AWS
+// access key ID keeps its last 4 characters so the key in use can still be told apart
+func (c config) redacted() config {
+	if id := c.Credentials.AWSAccessKeyID; len(id) > 4 {
+		c.Credentials.AWSAccessKeyID = redacted + id[len(id)-4:]
+	} else if id != "" {
+		c.Credentials.AWSAccessKeyID = redacted
+	}
+
+	for _, s := range []*string{
+		&c.Tracer.AccessToken,
+		&c.Credentials.AWSSecretAccessKey,
+		&c.Credentials.AWSSessionToken,
+	} {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	return c
+}
+
+// validate checks the propagation formats and granularity are known
+func (ct clientTracing) validate(prefix string) validationError {
+	var ve validationError
+	for _, name := range ct.Propagation {
+		if xrayport.LookupPropagator(name) == nil {
+			ve = append(ve, fieldError{prefix + "propagation", fmt.Sprintf("Bad propagation format %v", name)})
+		}
+	}
+	if _, ok := xrayport.ParseGranularity(ct.Granularity); !ok {
+		ve = append(ve, fieldError{prefix + "granularity", fmt.Sprintf("Bad granularity %v", ct.Granularity)})
+	}
+	return ve
+}
+
+// options returns the xrayport options for the backend's client, sampling with sampler
+func (ct clientTracing) options() []xrayport.ClientOption {
+	g, _ := xrayport.ParseGranularity(ct.Granularity)
+	return []xrayport.ClientOption{propagators(ct.Propagation), xrayport.WithGranularity(g), xrayport.WithSampler(sampler)}
+}
+
+// propagators returns the xrayport option sending trace headers in the named formats
+func propagators(names []string) xrayport.ClientOption {
+	var p []xrayport.Propagator
+	for _, name := range names {
+		p = append(p, xrayport.LookupPropagator(name))
+	}
+	return xrayport.WithPropagators(p...)
+}
+
+// splitList splits a comma separated environment value, dropping blanks
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ObjCheckConfig returns the effective configuration with secrets redacted
+func ObjCheckConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(cfg.redacted())
+}
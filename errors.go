@@ -0,0 +1,206 @@
+package objcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/smithy-go"
+	"google.golang.org/api/googleapi"
+)
+
+// errorClass groups fetch errors by the phase or reason they failed
+type errorClass string
+
+const (
+	classNone     errorClass = "none"
+	classDNS      errorClass = "dns"
+	classConnect  errorClass = "connect"
+	classTLS      errorClass = "tls"
+	classHTTP     errorClass = "http"
+	classThrottle errorClass = "throttle"
+	classTimeout  errorClass = "timeout"
+	classBodyRead errorClass = "body_read"
+	classOther    errorClass = "other"
+)
+
+// failure is the classification of a fetch error, Status is set for HTTP failures
+type failure struct {
+	Class  errorClass
+	Status int
+}
+
+// bodyReadError marks an error reading the object data after the response arrived
+type bodyReadError struct {
+	err error
+}
+
+func (be bodyReadError) Error() string {
+	return "body read: " + be.err.Error()
+}
+
+// classify returns the class of an error from a fetch made with ctx, combining context
+// errors, HTTP status codes, SDK error codes, the failed connection phase seen by at
+// and finally the type of the underlying network error
+func classify(ctx context.Context, err error, at *attemptTrace) failure {
+	if err == nil {
+		return failure{Class: classNone}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return failure{Class: classTimeout}
+	}
+
+	if isThrottle(err) {
+		f := failure{Class: classThrottle}
+		if rf, ok := err.(awserr.RequestFailure); ok {
+			f.Status = rf.StatusCode()
+		}
+		if re, ok := v2ResponseError(err); ok {
+			f.Status = re.HTTPStatusCode()
+		}
+		return f
+	}
+
+	bodyRead := false
+	for err != nil {
+		switch e := err.(type) {
+		case timeoutError:
+			return failure{Class: classTimeout}
+		case bodyReadError:
+			bodyRead = true
+			err = e.err
+		case *statusError:
+			return statusFailure(e.Code, nil)
+		case *googleapi.Error:
+			return statusFailure(e.Code, e.Errors)
+		case awserr.RequestFailure:
+			if e.StatusCode() != 0 {
+				return statusFailure(e.StatusCode(), nil)
+			}
+			err = e.OrigErr()
+		case awserr.Error:
+			if e.Code() == request.CanceledErrorCode && ctx.Err() != nil {
+				return failure{Class: classTimeout}
+			}
+			err = e.OrigErr()
+		case *smithy.OperationError:
+			err = e.Err
+		case *awsv2.RequestCanceledError:
+			if ctx.Err() != nil {
+				return failure{Class: classTimeout}
+			}
+			err = e.Err
+		case attemptError:
+			err = e.err
+		case *url.Error:
+			err = e.Err
+		default:
+			if re, ok := v2ResponseError(err); ok {
+				if re.HTTPStatusCode() != 0 {
+					return statusFailure(re.HTTPStatusCode(), nil)
+				}
+				err = re.Err
+				continue
+			}
+			if err == context.DeadlineExceeded {
+				return failure{Class: classTimeout}
+			}
+			// The GCS library returns its own error for a 404 rather than the response's
+			if err == storage.ErrObjectNotExist || err == storage.ErrBucketNotExist {
+				return statusFailure(http.StatusNotFound, nil)
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return failure{Class: classTimeout}
+			}
+			if bodyRead {
+				return failure{Class: classBodyRead}
+			}
+			if phase := at.failedPhase(); phase != "" {
+				return failure{Class: phase}
+			}
+			return failure{Class: errorTypeClass(err)}
+		}
+	}
+
+	if bodyRead {
+		return failure{Class: classBodyRead}
+	}
+
+	return failure{Class: classOther}
+}
+
+// isThrottle reports whether err is an AWS throttling error, including S3's SlowDown
+// which the SDK doesn't count as one. Errors from the v2 SDK are checked against the
+// same codes.
+func isThrottle(err error) bool {
+	if re, ok := v2ResponseError(err); ok {
+		apiErr, ok := re.Err.(smithy.APIError)
+		if !ok {
+			return false
+		}
+		err = awserr.New(apiErr.ErrorCode(), apiErr.ErrorMessage(), nil)
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "SlowDown" {
+		return true
+	}
+	return request.IsErrorThrottle(err)
+}
+
+// v2ResponseError returns the HTTP response error within an error from the v2 SDK. Service
+// clients wrap it in their own types, such as S3's s3shared.ResponseError, so it is
+// looked for with errors.As rather than by type.
+func v2ResponseError(err error) (*awshttp.ResponseError, bool) {
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) {
+		return re, true
+	}
+	return nil, false
+}
+
+// statusFailure classifies a failed HTTP status along with any googleapi error reasons
+func statusFailure(code int, items []googleapi.ErrorItem) failure {
+	if code == 429 {
+		return failure{Class: classThrottle, Status: code}
+	}
+	for _, item := range items {
+		if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+			return failure{Class: classThrottle, Status: code}
+		}
+	}
+	return failure{Class: classHTTP, Status: code}
+}
+
+// errorTypeClass classifies a network error by its type when no phase failure was seen
+func errorTypeClass(err error) errorClass {
+	switch e := err.(type) {
+	case *net.DNSError:
+		return classDNS
+	case *net.OpError:
+		if e.Op == "dial" {
+			if _, ok := e.Err.(*net.DNSError); ok {
+				return classDNS
+			}
+			return classConnect
+		}
+		return errorTypeClass(e.Err)
+	case tls.RecordHeaderError, x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+		return classTLS
+	}
+
+	if strings.HasPrefix(err.Error(), "tls: ") {
+		return classTLS
+	}
+
+	return classOther
+}
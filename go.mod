@@ -5,17 +5,16 @@ go 1.11
 require (
 	cloud.google.com/go v0.37.0
 	github.com/aws/aws-sdk-go v1.19.37
-	github.com/aws/aws-xray-sdk-go v0.9.4
-	github.com/cihub/seelog v0.0.0-20170130134532-f561c5e57575 // indirect
+	github.com/aws/aws-sdk-go-v2 v1.0.0
+	github.com/aws/aws-sdk-go-v2/config v1.0.0
+	github.com/aws/aws-sdk-go-v2/credentials v1.0.0
+	github.com/aws/aws-sdk-go-v2/service/s3 v1.0.0
+	github.com/aws/smithy-go v1.0.0
 	github.com/lightstep/lightstep-tracer-common v1.0.3 // indirect
 	github.com/lightstep/lightstep-tracer-go v0.16.0
 	github.com/onsi/ginkgo v1.8.0 // indirect
 	github.com/onsi/gomega v1.5.0 // indirect
-	github.com/opentracing-contrib/go-aws-sdk v0.0.0-20190205132030-9c29407076c0
-	github.com/opentracing-contrib/go-stdlib v0.0.0-20190519235532-cf7a6c988dc9
 	github.com/opentracing/opentracing-go v1.1.0
-	github.com/pkg/errors v0.8.1 // indirect
-	go.opencensus.io v0.18.0
 	golang.org/x/oauth2 v0.0.0-20181203162652-d668ce993890
 	google.golang.org/api v0.1.0
 )
@@ -0,0 +1,183 @@
+package objcheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultBucketTemplate reproduces the original prefix-region bucket naming
+const defaultBucketTemplate = "{prefix}-{region}"
+
+// templateVarPattern matches the placeholders in a bucket naming template
+var templateVarPattern = regexp.MustCompile(`\{[a-z]+\}`)
+
+// templateVars are the placeholders a bucket naming template can use
+var templateVars = map[string]bool{
+	"{prefix}":   true,
+	"{provider}": true,
+	"{region}":   true,
+	"{env}":      true,
+	"{project}":  true,
+	"{account}":  true,
+	"{target}":   true,
+}
+
+// targetConfig maps a logical target name to a bucket and where it lives,
+// with the bucket name built from the service's template when Bucket is empty
+type targetConfig struct {
+	Service string `json:"service"`
+	Region  string `json:"region"`
+	Bucket  string `json:"bucket"`
+	Project string `json:"project"`
+	Account string `json:"account"`
+}
+
+// checkTarget is a fully resolved bucket to check
+type checkTarget struct {
+	Name    string
+	Service string
+	Region  string
+	Bucket  string
+	Project string
+	Account string
+}
+
+// validateTemplate checks a bucket naming template only uses known placeholders
+func validateTemplate(template string) error {
+	if template == "" {
+		return fmt.Errorf("Empty bucket template")
+	}
+	for _, v := range templateVarPattern.FindAllString(template, -1) {
+		if !templateVars[v] {
+			return fmt.Errorf("Bad bucket template %q: unknown placeholder %v", template, v)
+		}
+	}
+	return nil
+}
+
+// bucketTemplate returns the naming template for a service
+func (n namingConfig) bucketTemplate(service string) string {
+	if t := n.Templates[service]; t != "" {
+		return t
+	}
+	return defaultBucketTemplate
+}
+
+// bucketName expands the service's naming template for a target
+func (n namingConfig) bucketName(t checkTarget) string {
+	r := strings.NewReplacer(
+		"{prefix}", n.BucketPrefix,
+		"{provider}", t.Service,
+		"{region}", t.Region,
+		"{env}", n.Env,
+		"{project}", t.Project,
+		"{account}", t.Account,
+		"{target}", t.Name,
+	)
+	return r.Replace(n.bucketTemplate(t.Service))
+}
+
+// targetSpec names one thing to check in a request, either a logical target from the
+// target table (or "all"), or a service and region. In JSON it can be written as just
+// the target name.
+type targetSpec struct {
+	Target  string `json:"target"`
+	Service string `json:"service"`
+	Region  string `json:"region"`
+}
+
+// UnmarshalJSON accepts either a target name string or a target object
+func (ts *targetSpec) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*ts = targetSpec{Target: name}
+		return nil
+	}
+
+	type plain targetSpec
+	return json.Unmarshal(data, (*plain)(ts))
+}
+
+// resolveTarget turns a validated target spec into the bucket to check, using the target
+// table for logical targets and the naming templates otherwise
+func (c config) resolveTarget(ts targetSpec) checkTarget {
+	t := checkTarget{
+		Service: ts.Service,
+		Region:  ts.Region,
+	}
+
+	if tc, ok := c.Targets[ts.Target]; ok && ts.Target != "" {
+		t = checkTarget{
+			Name:    ts.Target,
+			Service: tc.Service,
+			Region:  tc.Region,
+			Bucket:  tc.Bucket,
+			Project: tc.Project,
+			Account: tc.Account,
+		}
+	}
+
+	if t.Bucket == "" {
+		t.Bucket = c.Naming.bucketName(t)
+	}
+
+	return t
+}
+
+// allTargets returns the targets checked for "all": every configured target followed by
+// the configured regions, skipping those of disabled services
+func (c config) allTargets() []checkTarget {
+	var targets []checkTarget
+
+	names := make([]string, 0, len(c.Targets))
+	for name := range c.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if t := c.resolveTarget(targetSpec{Target: name}); c.enabled(t.Service) {
+			targets = append(targets, t)
+		}
+	}
+
+	for _, region := range c.Regions {
+		ri, ok := catalog.lookup(region)
+		if !ok || !c.enabled(ri.Provider) {
+			continue
+		}
+		targets = append(targets, c.resolveTarget(targetSpec{Service: ri.Provider, Region: region}))
+	}
+
+	return targets
+}
+
+// expandTargets resolves the target specs of a request, expanding "all" and
+// dropping repeats of a bucket
+func (c config) expandTargets(specs []targetSpec) []checkTarget {
+	var targets []checkTarget
+	seen := make(map[string]bool)
+
+	add := func(t checkTarget) {
+		key := t.Service + "/" + t.Bucket
+		if !seen[key] {
+			seen[key] = true
+			targets = append(targets, t)
+		}
+	}
+
+	for _, ts := range specs {
+		if ts.Target == "all" {
+			for _, t := range c.allTargets() {
+				add(t)
+			}
+		} else {
+			add(c.resolveTarget(ts))
+		}
+	}
+
+	return targets
+}
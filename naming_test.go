@@ -0,0 +1,120 @@
+package objcheck
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBucketName(t *testing.T) {
+	n := defaultConfig().Naming
+	tgt := checkTarget{Service: "gcs", Region: "us-east1"}
+	if b := n.bucketName(tgt); b != "objcheck-us-east1" {
+		t.Errorf("Default bucket name was %v", b)
+	}
+
+	n.Env = "prod"
+	n.Templates = map[string]string{"s3": "{prefix}-{provider}-{region}-{env}"}
+	if b := n.bucketName(checkTarget{Service: "s3", Region: "us-east-2"}); b != "objcheck-s3-us-east-2-prod" {
+		t.Errorf("Templated bucket name was %v", b)
+	}
+	if b := n.bucketName(tgt); b != "objcheck-us-east1" {
+		t.Errorf("Service without template bucket name was %v", b)
+	}
+
+	if err := validateTemplate("{prefix}-{zone}"); err == nil {
+		t.Error("Missing error for unknown placeholder")
+	}
+	if err := validateTemplate("{prefix}-{provider}-{region}-{env}-{project}-{account}-{target}"); err != nil {
+		t.Errorf("Unexpected error %v", err.Error())
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+
+	cfg = defaultConfig()
+	cfg.Targets = map[string]targetConfig{
+		"corp-logs": {Service: "s3", Region: "us-west-2", Bucket: "corp-logs-bucket", Account: "123456789012"},
+		"analytics": {Service: "gcs", Region: "us-central1", Project: "analytics-prj"},
+	}
+	cfg.Naming.Templates["gcs"] = "{project}-{target}-{region}"
+
+	tgt := cfg.resolveTarget(targetSpec{Target: "corp-logs"})
+	if tgt.Bucket != "corp-logs-bucket" || tgt.Service != "s3" || tgt.Region != "us-west-2" || tgt.Account != "123456789012" {
+		t.Errorf("Explicit target resolved to %v", tgt)
+	}
+
+	tgt = cfg.resolveTarget(targetSpec{Target: "analytics"})
+	if tgt.Bucket != "analytics-prj-analytics-us-central1" {
+		t.Errorf("Templated target bucket was %v", tgt.Bucket)
+	}
+
+	tgt = cfg.resolveTarget(targetSpec{Service: "s3", Region: "us-east-1"})
+	if tgt.Bucket != "objcheck-us-east-1" {
+		t.Errorf("Service and region bucket was %v", tgt.Bucket)
+	}
+
+	ocr := objCheckRequest{Target: "corp-logs", Pool: 10, Count: 1}
+	if err := ocr.validate(); err != nil {
+		t.Errorf("Unexpected error %v", err.Error())
+	}
+
+	ocr = objCheckRequest{Target: "corp-logs", Service: "gcs", Pool: 10, Count: 1}
+	if err := ocr.validate(); err == nil {
+		t.Error("Missing error for conflicting service")
+	}
+
+	ocr = objCheckRequest{Target: "nope", Pool: 10, Count: 1}
+	if err := ocr.validate(); err == nil || err.Error() != "Bad target nope" {
+		t.Errorf("Incorrect error for bad target %v", err)
+	}
+}
+
+func TestExpandTargets(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+
+	cfg = defaultConfig()
+	cfg.Backends.S3.Enabled = false
+	cfg.Targets = map[string]targetConfig{
+		"corp-logs": {Service: "s3", Region: "us-west-2", Bucket: "corp-logs-bucket"},
+		"analytics": {Service: "gcs", Region: "us-central1", Bucket: "analytics-bucket"},
+	}
+
+	var ocr objCheckRequest
+	err := json.Unmarshal([]byte(`{"targets": ["all", {"service": "gcs", "region": "us-east1"}, "analytics"], "pool": 10, "count": 5}`), &ocr)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err.Error())
+	}
+	if len(ocr.Targets) != 3 || ocr.Targets[0].Target != "all" || ocr.Targets[1].Region != "us-east1" {
+		t.Fatalf("Targets decoded as %v", ocr.Targets)
+	}
+
+	buckets := []string{"analytics-bucket", "objcheck-us-central1", "objcheck-us-east1", "objcheck-asia-east2", "objcheck-europe-west2"}
+	targets := cfg.expandTargets(ocr.specs())
+	if len(targets) != len(buckets) {
+		t.Fatalf("Expanded to %v", targets)
+	}
+	for i, tgt := range targets {
+		if tgt.Bucket != buckets[i] {
+			t.Errorf("Target %v was %v instead of %v", i, tgt.Bucket, buckets[i])
+		}
+	}
+
+	if err := ocr.validate(); err != nil {
+		t.Errorf("Unexpected error %v", err.Error())
+	}
+
+	ocr = objCheckRequest{Targets: []targetSpec{{Target: "corp-logs"}, {Service: "gcs", Region: "us-west-9"}}, Service: "gcs", Pool: 10, Count: 1}
+	err = ocr.validate()
+	ve, ok := err.(validationError)
+	if !ok || len(ve) != 3 {
+		t.Fatalf("Incorrect errors for bad targets %v", err)
+	}
+	for i, field := range []string{"targets", "targets[0].service", "targets[1].region"} {
+		if ve[i].Field != field {
+			t.Errorf("Field %v was %v instead of %v", i, ve[i].Field, field)
+		}
+	}
+}
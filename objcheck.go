@@ -10,15 +10,20 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
-	"regexp"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 
 	"github.com/1mentat/saastrace_aafunc/xrayport"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	awsv2config "github.com/aws/aws-sdk-go-v2/config"
+	s3v2 "github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 
@@ -28,142 +33,425 @@ import (
 	"github.com/opentracing/opentracing-go/mocktracer"
 )
 
-// init on Cloud Function startup, initializes the LightStep tracer from environment variables
-// or uses OpenTracing mocktracer
+// init on Cloud Function startup, loads the configuration and initializes the LightStep or X-Ray
+// tracer or uses OpenTracing mocktracer. An invalid configuration stops the function from starting.
 func init() {
-	gitTag := os.Getenv("GIT_TAG")
-
-	if gitTag == "" {
-		gitTag = "unknown"
+	c, rc, err := loadConfig(os.LookupEnv)
+	if err != nil {
+		panic(fmt.Sprintf("invalid configuration: %v", err.Error()))
 	}
 
-	token := os.Getenv("LS_ACCESS_TOKEN")
+	cfg = c
+	catalog = rc
 
-	if token == "" {
-		fmt.Println("Token from environment failed using mocktracer")
+	if cfg.Tracer.SamplingRulesFile != "" {
+		sampler, err = xrayport.LoadSampler(cfg.Tracer.SamplingRulesFile)
+		if err != nil {
+			panic(fmt.Sprintf("invalid configuration: %v", err.Error()))
+		}
+	}
+
+	if cfg.Tracer.XRayDaemonAddress != "" {
+		tracer, err := xrayport.NewTracer(xrayport.TracerOptions{
+			DaemonAddress: cfg.Tracer.XRayDaemonAddress,
+			Tags:          opentracing.Tags{"region": cfg.Tracer.FunctionRegion, "version": cfg.Tracer.Version},
+		})
+		if err != nil {
+			panic(fmt.Sprintf("invalid configuration: %v", err.Error()))
+		}
+		opentracing.SetGlobalTracer(tracer)
+	} else if cfg.Tracer.AccessToken == "" {
+		fmt.Println("No access token configured using mocktracer")
 		tracer := mocktracer.New()
 		opentracing.SetGlobalTracer(tracer)
 	} else {
 		tracer := lightstep.NewTracer(lightstep.Options{
-			AccessToken: token,
-			Tags:        opentracing.Tags{"region": os.Getenv("FUNCTION_REGION"), "version": gitTag},
+			AccessToken: cfg.Tracer.AccessToken,
+			Tags:        opentracing.Tags{"region": cfg.Tracer.FunctionRegion, "version": cfg.Tracer.Version},
 		})
 		opentracing.SetGlobalTracer(tracer)
 	}
 
-	prefix := os.Getenv("BUCKET_PREFIX")
+	effective, _ := json.Marshal(cfg.redacted())
+	fmt.Printf("config %s\n", effective)
 
-	matched, err := regexp.MatchString(`^[a-zA-Z0-9_-]+$`, prefix)
+	fmt.Println("init() done")
+}
 
-	if err != nil {
-		fmt.Printf("regexp against prefix error %v", err.Error())
-		matched = false
-	}
+// services contains the storage services ObjCheck knows how to check
+var services = map[string]bool{
+	"gcs": true,
+	"s3":  true,
+}
 
-	if !matched {
-		fmt.Println("Using standard prefix of objcheck - probably won't work")
-		bucketPrefix = "objcheck"
-	} else {
-		bucketPrefix = prefix
+// objCheckRequest holds cloud storage performance check parameters
+type objCheckRequest struct {
+	Service       string       `json:"service"`
+	Region        string       `json:"region"`
+	Pool          int          `json:"pool"`
+	Count         int          `json:"count"`
+	Size          string       `json:"size"`
+	BucketPrefix  string       `json:"bucket_prefix"`
+	Target        string       `json:"target"`
+	Targets       []targetSpec `json:"targets"`
+	Parallel      bool         `json:"parallel"`
+	ObjectTimeout duration     `json:"object_timeout"`
+	Deadline      duration     `json:"deadline"`
+	Retry         *retryPolicy `json:"retry"`
+	networkOptions
+}
+
+// checkOptions are the request settings that apply to each object fetch
+type checkOptions struct {
+	ObjectTimeout time.Duration
+	Retry         retryPolicy
+	Network       networkOptions
+}
+
+// options returns the per-object settings for the request
+func (ocr objCheckRequest) options() checkOptions {
+	return checkOptions{
+		ObjectTimeout: time.Duration(ocr.ObjectTimeout),
+		Retry:         *ocr.Retry,
+		Network:       ocr.networkOptions,
 	}
+}
 
-	fmt.Println("init() done")
+// specs returns the targets to check, a request names either a list of targets
+// or a single target, service and region
+func (ocr objCheckRequest) specs() []targetSpec {
+	if len(ocr.Targets) > 0 {
+		return ocr.Targets
+	}
+	return []targetSpec{{Target: ocr.Target, Service: ocr.Service, Region: ocr.Region}}
 }
 
-var bucketPrefix string
+// decodeRequest reads a check request, decoding its retry policy over a copy of the default
+// policy so that the fields a request leaves out keep their defaults
+func decodeRequest(r io.Reader, d checkDefaults) (objCheckRequest, error) {
+	rp := d.Retry
+	rp.RetryOn = append([]string(nil), d.Retry.RetryOn...)
+	ocr := objCheckRequest{Retry: &rp}
+	err := json.NewDecoder(r).Decode(&ocr)
+	return ocr, err
+}
 
-var services = map[string]bool{
-	"gcs": true,
-	"s3":  true,
+// applyDefaults fills in check parameters left out of the request from the configured defaults
+func (ocr *objCheckRequest) applyDefaults(d checkDefaults) {
+	if ocr.Pool == 0 {
+		ocr.Pool = d.Pool
+	}
+	if ocr.Count == 0 {
+		ocr.Count = d.Count
+	}
+	if ocr.Size == "" {
+		ocr.Size = d.Size
+	}
+	if ocr.ObjectTimeout == 0 {
+		ocr.ObjectTimeout = d.ObjectTimeout
+	}
+	if ocr.Deadline == 0 {
+		ocr.Deadline = d.Deadline
+	}
+	if ocr.Retry == nil {
+		rp := d.Retry
+		ocr.Retry = &rp
+	}
 }
 
-// bucketRegions map contains supported bucket region names
-var bucketRegions = map[string]string{
-	"us-central1":  "gcs",
-	"us-east1":     "gcs",
-	"europe-west2": "gcs",
-	"asia-east2":   "gcs",
-	"us-east-2":    "s3",
-	"us-west-2":    "s3",
-	"us-east-1":    "s3",
-	"eu-west-2":    "s3",
+// fieldError describes a single problem with one field of a check request
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
-// objCheckRequest holds cloud storage performance check parameters
-type objCheckRequest struct {
-	Service string `json:"service"`
-	Region  string `json:"region"`
-	Pool    int    `json:"pool"`
-	Count   int    `json:"count"`
+// validationError collects every problem found while validating a check request
+type validationError []fieldError
+
+func (ve validationError) Error() string {
+	msgs := make([]string, len(ve))
+	for i, fe := range ve {
+		msgs[i] = fe.Message
+	}
+	return strings.Join(msgs, "; ")
 }
 
-// Validate validates the requested check for service, region, pool, and count of objects to request
+// Validate validates the requested check for targets, pool, and count of objects to request
+// and reports all problems found rather than just the first
 func (ocr objCheckRequest) validate() error {
-	if !services[ocr.Service] {
-		return fmt.Errorf("Bad service %v", ocr.Service)
+	var ve validationError
+
+	if len(ocr.Targets) > 0 {
+		if ocr.Target != "" || ocr.Service != "" || ocr.Region != "" {
+			ve = append(ve, fieldError{"targets", "Bad request: targets can't be combined with target, service or region"})
+		}
+		for i, ts := range ocr.Targets {
+			ve = append(ve, ts.validate(fmt.Sprintf("targets[%v].", i))...)
+		}
+	} else {
+		ve = append(ve, ocr.specs()[0].validate("")...)
+	}
+
+	if !cfg.poolAllowed(ocr.Pool) {
+		ve = append(ve, fieldError{"pool", fmt.Sprintf("Bad pool %v", ocr.Pool)})
+	}
+
+	if ocr.Count < 1 || ocr.Count > cfg.Limits.MaxCount {
+		ve = append(ve, fieldError{"count", "Bad count"})
 	}
 
-	if bucketRegions[ocr.Region] == "" {
-		return fmt.Errorf("Bad region %v", ocr.Region)
+	if ocr.Size != "" && !cfg.sizeAllowed(ocr.Size) {
+		ve = append(ve, fieldError{"size", fmt.Sprintf("Bad size %v", ocr.Size)})
 	}
 
-	if bucketRegions[ocr.Region] != ocr.Service {
-		return fmt.Errorf("Bad service / region combination: %v and %v", ocr.Service, ocr.Region)
+	if ocr.BucketPrefix != "" && !prefixPattern.MatchString(ocr.BucketPrefix) {
+		ve = append(ve, fieldError{"bucket_prefix", fmt.Sprintf("Bad bucket prefix %q", ocr.BucketPrefix)})
 	}
 
-	if ocr.Pool != 10 {
-		return fmt.Errorf("Bad pool %v", ocr.Pool)
+	if ocr.ObjectTimeout < 0 {
+		ve = append(ve, fieldError{"object_timeout", fmt.Sprintf("Bad object timeout %v", ocr.ObjectTimeout)})
 	}
 
-	if ocr.Count < 1 || ocr.Count > 1000 {
-		return errors.New("Bad count")
+	if ocr.Deadline < 0 {
+		ve = append(ve, fieldError{"deadline", fmt.Sprintf("Bad deadline %v", ocr.Deadline)})
+	}
+
+	if ocr.Retry != nil {
+		ve = append(ve, ocr.Retry.validate("retry.")...)
+	}
+
+	ve = append(ve, ocr.networkOptions.validate("")...)
+
+	if len(ve) > 0 {
+		return ve
 	}
 
 	return nil
 }
 
+// validate checks a single target spec for service and region, field names are given the prefix
+func (ts targetSpec) validate(prefix string) validationError {
+	var ve validationError
+
+	if ts.Target == "all" {
+		if ts.Service != "" || ts.Region != "" {
+			ve = append(ve, fieldError{prefix + "target", "Bad target: all can't be combined with service or region"})
+		}
+		if len(cfg.allTargets()) == 0 {
+			ve = append(ve, fieldError{prefix + "target", "No targets configured for all"})
+		}
+		return ve
+	}
+
+	service, region := ts.Service, ts.Region
+	if ts.Target != "" {
+		t, ok := cfg.Targets[ts.Target]
+		if !ok {
+			return append(ve, fieldError{prefix + "target", fmt.Sprintf("Bad target %v", ts.Target)})
+		}
+		if service != "" && service != t.Service {
+			ve = append(ve, fieldError{prefix + "service", fmt.Sprintf("Target %v is service %v not %v", ts.Target, t.Service, service)})
+		}
+		if region != "" && region != t.Region {
+			ve = append(ve, fieldError{prefix + "region", fmt.Sprintf("Target %v is region %v not %v", ts.Target, t.Region, region)})
+		}
+		service, region = t.Service, t.Region
+	}
+
+	if !services[service] {
+		ve = append(ve, fieldError{prefix + "service", fmt.Sprintf("Bad service %v", service)})
+	} else if !cfg.enabled(service) {
+		ve = append(ve, fieldError{prefix + "service", fmt.Sprintf("Service %v disabled", service)})
+	}
+
+	if ri, ok := catalog.lookup(region); !ok {
+		ve = append(ve, fieldError{prefix + "region", fmt.Sprintf("Bad region %v", region)})
+	} else if services[service] && ri.Provider != service {
+		ve = append(ve, fieldError{prefix + "region", fmt.Sprintf("Bad service / region combination: %v and %v", service, region)})
+	}
+
+	return ve
+}
+
+// errorResponse is the JSON body returned by ObjCheck when a check can't be run
+type errorResponse struct {
+	Error  string       `json:"error"`
+	Reason string       `json:"reason"`
+	Fields []fieldError `json:"fields,omitempty"`
+}
+
+// writeError tags the span with err and writes a JSON error body with the given HTTP status code
+func writeError(w http.ResponseWriter, span opentracing.Span, status int, code string, err error) {
+	span.SetTag("error", true)
+	span.SetTag("http.status_code", status)
+	span.LogEvent(err.Error())
+
+	resp := errorResponse{Error: code, Reason: err.Error()}
+	if ve, ok := err.(validationError); ok {
+		resp.Fields = ve
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// objCheckHandler continues the caller's trace, if any, in the ObjCheck span
+var objCheckHandler = xrayport.Handler("ObjCheck", http.HandlerFunc(objCheck))
+
 // ObjCheck measures the latency to fetch objects from pools in different regions in Google Cloud Storage
 // triggered by HTTP requests to the deployed Google Cloud Function endpoint
 func ObjCheck(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	span, ctx := opentracing.StartSpanFromContext(ctx, "ObjCheck")
-	defer span.Finish()
+	objCheckHandler.ServeHTTP(w, r)
+}
+
+func objCheck(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := opentracing.SpanFromContext(ctx)
 
-	decoder := json.NewDecoder(r.Body)
-	var ocr objCheckRequest
-	err := decoder.Decode(&ocr)
+	ocr, err := decodeRequest(r.Body, cfg.Defaults)
 	if err != nil {
-		span.SetTag("error", true)
-		span.LogEvent(err.Error())
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Write([]byte("Data Error"))
+		writeError(w, span, http.StatusBadRequest, "decode_error", err)
 		return
 	}
 
+	ocr.applyDefaults(cfg.Defaults)
+
 	err = ocr.validate()
 	if err != nil {
-		span.SetTag("error", true)
-		span.LogEvent(err.Error())
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Write([]byte("Request Error"))
+		writeError(w, span, http.StatusUnprocessableEntity, "validation_error", err)
 		return
 	}
 
-	objList, err := createObjList(ctx, ocr.Pool, ocr.Count, "1k")
+	rcfg := cfg.withOverrides(ocr)
+
+	objList, err := createObjList(ctx, ocr.Pool, ocr.Count, ocr.Size)
 	if err != nil {
-		span.SetTag("error", true)
-		span.LogEvent(err.Error())
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Write([]byte("List Error"))
+		writeError(w, span, http.StatusInternalServerError, "list_error", err)
 		return
 	}
 
-	bucket := fmt.Sprintf("%v-%v", bucketPrefix, ocr.Region)
+	targets := rcfg.expandTargets(ocr.specs())
+	span.SetTag("targets", len(targets))
+	span.SetTag("parallel", ocr.Parallel)
 
+	opts := ocr.options()
+	if ocr.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(ocr.Deadline))
+		defer cancel()
+		span.SetTag("deadline", ocr.Deadline.String())
+	}
+	if opts.ObjectTimeout > 0 {
+		span.SetTag("object_timeout", opts.ObjectTimeout.String())
+	}
+	if opts.Network.Resolver != "" {
+		span.SetTag("resolver", opts.Network.Resolver)
+	}
+	span.SetTag("fresh_dns", opts.Network.FreshDNS)
+	span.SetTag("cold_tls", opts.Network.ColdTLS)
+	if opts.Network.IPFamily != "" {
+		span.SetTag("ip_family", opts.Network.IPFamily)
+	}
+	if opts.Network.HTTPVersion != "" {
+		span.SetTag("http_version", opts.Network.HTTPVersion)
+	}
+	if opts.Retry.Disabled {
+		span.SetTag("max_attempts", 1)
+	} else {
+		span.SetTag("max_attempts", opts.Retry.MaxAttempts)
+	}
+
+	result := checkResult{
+		Pool:     ocr.Pool,
+		Count:    ocr.Count,
+		Size:     ocr.Size,
+		Parallel: ocr.Parallel,
+		Targets:  make([]targetResult, len(targets)),
+	}
+
+	// Targets run one at a time unless the check is parallel, a panic while checking a
+	// target is reported as its error rather than ending the function
+	limit := 1
+	if ocr.Parallel {
+		limit = 0
+	}
+	g, _ := xrayport.NewGroup(ctx, xrayport.WithLimit(limit), xrayport.WithCaptureOptions(xrayport.RecoverPanics()))
+
+	start := time.Now()
+	for i, tgt := range targets {
+		i, tgt := i, tgt
+		result.Targets[i] = newTargetResult(tgt)
+		g.Go("checkTarget", func(ctx context.Context) error {
+			result.Targets[i] = runTarget(ctx, tgt, opts, objList)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		span.SetTag("error", true)
+		if ge, ok := err.(xrayport.GroupError); ok {
+			for _, te := range ge {
+				result.Targets[te.Index].Errors = append(result.Targets[te.Index].Errors, te.Err.Error())
+			}
+		} else {
+			result.Errors = append(result.Errors, err.Error())
+		}
+	}
+	for i := range result.Targets {
+		result.Connections.merge(result.Targets[i].Connections)
+	}
+	result.DurationMS = milliseconds(time.Since(start))
+	result.DeadlineExceeded = ctx.Err() == context.DeadlineExceeded
+	if result.DeadlineExceeded {
+		span.SetTag("deadline_exceeded", true)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(result)
+}
+
+// runTarget fetches every object in the list from one target under the checkTarget span
+// in ctx, or its own span when there isn't one
+func runTarget(ctx context.Context, tgt checkTarget, opts checkOptions, objList []string) targetResult {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		span, ctx = opentracing.StartSpanFromContext(ctx, "checkTarget")
+		defer span.Finish()
+	}
+
+	ri, _ := catalog.lookup(tgt.Region)
+	span.SetTag("service", tgt.Service)
+	span.SetTag("bucket", tgt.Bucket)
+	span.SetTag("bucket_region", ri.Name)
+	span.SetTag("bucket_location", ri.DisplayName)
+	span.SetTag("bucket_continent", ri.Continent)
+	if tgt.Name != "" {
+		span.SetTag("target", tgt.Name)
+	}
+
+	tr := newTargetResult(tgt)
+	start := time.Now()
 	for idx, obj := range objList {
-		requestObject(ctx, ocr.Service, ocr.Region, bucket, obj, idx)
+		if ctx.Err() != nil {
+			// The deadline passed or the caller went away, report what was fetched
+			tr.Skipped = len(objList) - idx
+			span.SetTag("skipped", tr.Skipped)
+			break
+		}
+		objStart := time.Now()
+		attempts, err := requestObject(ctx, tgt, opts, obj, idx)
+		tr.record(obj, time.Since(objStart), attempts, err)
 	}
+	tr.DurationMS = milliseconds(time.Since(start))
 
+	span.SetTag("succeeded", tr.Succeeded)
+	span.SetTag("failed", tr.Failed)
+	span.SetTag("timeouts", tr.Timeouts)
+	if tr.Failed > 0 {
+		span.SetTag("error", true)
+	}
+
+	return tr
 }
 
 // createObjList creates a list of random object keys given a pool and a number of objects to fetch
@@ -189,102 +477,340 @@ func createObjList(ctx context.Context, poolSize int, count int, size string) ([
 	return objects, nil
 }
 
-// requestObject uses the Google Cloud Storage SDK to read an object from a bucket
-// It reads all the data for the object but throws aways the actual contents
-func requestObject(ctx context.Context, service string, region string, bucket string, object string, idx int) {
+// requestObject reads an object from a target bucket with the service's SDK, retrying
+// according to the retry policy and giving up after the object timeout. It reads all the
+// data for the object but throws aways the actual contents
+func requestObject(ctx context.Context, tgt checkTarget, opts checkOptions, object string, idx int) ([]attemptResult, error) {
+	if idx == 0 {
+		// The first read of a target makes the connection, so is always traced
+		ctx = xrayport.WithSamplingDecision(ctx, true)
+	}
+
 	span, ctx := opentracing.StartSpanFromContext(ctx, "requestObject")
 	defer span.Finish()
 
-	span.SetTag("service", service)
-	span.SetTag("bucket", bucket)
+	span.SetTag("service", tgt.Service)
+	span.SetTag("bucket", tgt.Bucket)
 	span.SetTag("object", object)
 	span.SetTag("seq", idx)
+	if tgt.Name != "" {
+		span.SetTag("target", tgt.Name)
+	}
+	if tgt.Project != "" {
+		span.SetTag("project", tgt.Project)
+	}
+	if tgt.Account != "" {
+		span.SetTag("account", tgt.Account)
+	}
 
-	if service == "gcs" {
-		hc, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/devstorage.full_control")
-		if err != nil {
-			fmt.Printf("DefaultClient error %v\n", err.Error())
-			span.SetTag("error", true)
-			span.LogFields(log.String("error", err.Error()))
-			return
+	if opts.ObjectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.ObjectTimeout)
+		defer cancel()
+	}
+
+	fetch := fetchGCS
+	if tgt.Service == "s3" {
+		fetch = fetchS3
+		if cfg.Backends.S3.SDK == "v2" {
+			fetch = fetchS3V2
+		}
+	}
+
+	var attempts []attemptResult
+	var err error
+	var f failure
+	for attempt := 1; ; attempt++ {
+		at := &attemptTrace{}
+		start := time.Now()
+		err = fetch(at.withTrace(ctx), span, tgt, opts, object)
+		conn := at.connection()
+		bodyBytes, bodyTime := at.body()
+		ar := attemptResult{
+			Attempt:    attempt,
+			Outcome:    "ok",
+			DurationMS: milliseconds(time.Since(start)),
+			IPFamily:   at.ipFamily(),
+			Protocol:   at.httpProtocol(),
+			ConnID:     conn.ID,
+			RemoteAddr: conn.RemoteAddr,
+			Reused:     conn.Reused,
+			BodyBytes:  bodyBytes,
+			BodyMS:     milliseconds(bodyTime),
+			DNS:        at.dnsLookups(),
+			TLS:        at.tlsHandshakes(),
 		}
-		tc := xrayport.Client(hc)
 
-		client, err := storage.NewClient(ctx, option.WithHTTPClient(tc))
+		retry := false
+		f = classify(ctx, err, at)
 		if err != nil {
-			fmt.Printf("client error: %v\n", err.Error())
-			span.SetTag("error", true)
-			span.LogFields(
-				log.String("event", "client error"),
-				log.String("error", err.Error()),
-			)
-			return
+			ar.Outcome = "error"
+			ar.Class = f.Class
+			ar.Status = f.Status
+			ar.Error = err.Error()
+			retry = opts.Retry.shouldRetry(f, attempt) && ctx.Err() == nil
 		}
 
-		bkt := client.Bucket(bucket)
+		var delay time.Duration
+		if retry {
+			delay = opts.Retry.backoff(attempt)
+			ar.DelayMS = milliseconds(delay)
+		}
+		attempts = append(attempts, ar)
+
+		span.LogFields(
+			log.String("event", "attempt"),
+			log.Int("attempt", attempt),
+			log.String("outcome", ar.Outcome),
+			log.String("class", string(ar.Class)),
+			log.Float64("delay_ms", ar.DelayMS),
+		)
+
+		if !retry || sleep(ctx, delay) != nil {
+			break
+		}
+	}
 
-		obj := bkt.Object(object)
+	span.SetTag("attempts", len(attempts))
+	span.SetTag("error.class", string(f.Class))
 
-		rdr, err := obj.NewReader(ctx)
-		if err != nil {
-			fmt.Printf("obj error: %s for %v\n", err.Error(), object)
-			span.SetTag("error", true)
-			span.LogFields(
-				log.String("event", "obj error"),
-				log.String("error", err.Error()),
-			)
-			return
+	if err != nil {
+		span.SetTag("error", true)
+		if f.Status != 0 {
+			span.SetTag("error.status", f.Status)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			span.SetTag("timeout", true)
+			return attempts, timeoutError{err}
 		}
+	}
 
-		defer rdr.Close()
+	return attempts, err
+}
 
-		if _, err := io.Copy(ioutil.Discard, rdr); err != nil {
-			fmt.Printf("io error: %v for %v\n", err.Error(), object)
-			span.SetTag("error", true)
-			span.LogFields(
-				log.String("event", "io error"),
-				log.String("error", err.Error()),
-			)
-			return
-		}
-	} else if service == "s3" {
-		sess := session.Must(session.NewSession())
+// fetchGCS reads an object from a Google Cloud Storage bucket
+func fetchGCS(ctx context.Context, span opentracing.Span, tgt checkTarget, opts checkOptions, object string) error {
+	hc, err := gcsHTTPClient(ctx, transportFor(opts.Network))
+	if err != nil {
+		fmt.Printf("DefaultClient error %v\n", err.Error())
+		span.LogFields(log.String("error", err.Error()))
+		return err
+	}
+	tc := xrayport.Client(hc, cfg.Backends.GCS.options()...)
 
-		svc := s3.New(sess, &aws.Config{
-			Region:       aws.String(region),
-			UseDualStack: aws.Bool(true),
-		})
+	tc.Transport = noRetryTransport{tc.Transport}
 
-		xrayport.AWS(svc.Client)
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(tc))
+	if err != nil {
+		fmt.Printf("client error: %v\n", err.Error())
+		span.LogFields(
+			log.String("event", "client error"),
+			log.String("error", err.Error()),
+		)
+		return err
+	}
 
-		result, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(object),
-		})
+	bkt := client.Bucket(tgt.Bucket)
+	if tgt.Project != "" {
+		bkt = bkt.UserProject(tgt.Project)
+	}
+
+	obj := bkt.Object(object)
+
+	var rdr *storage.Reader
+	err = xrayport.GCS(ctx, "NewReader", tgt.Bucket, object, func(ctx context.Context) error {
+		var err error
+		rdr, err = obj.NewReader(ctx)
+		return err
+	}, xrayport.RecoverPanics(), xrayport.Sample(sampler, xrayport.SamplingRequest{
+		Host:      "storage.googleapis.com",
+		Method:    http.MethodGet,
+		URLPath:   "/" + tgt.Bucket + "/" + object,
+		Service:   "gcs",
+		Operation: "NewReader",
+	}))
+	if err != nil {
+		fmt.Printf("obj error: %s for %v\n", err.Error(), object)
+		span.LogFields(
+			log.String("event", "obj error"),
+			log.String("error", err.Error()),
+		)
+		return err
+	}
+
+	defer rdr.Close()
+
+	return readBody(ctx, span, object, rdr)
+}
 
+// fetchS3 reads an object from an AWS S3 bucket
+func fetchS3(ctx context.Context, span opentracing.Span, tgt checkTarget, opts checkOptions, object string) error {
+	sess, err := awsSession()
+	if err != nil {
+		fmt.Printf("session error: %v\n", err.Error())
+		span.LogFields(
+			log.String("event", "session error"),
+			log.String("error", err.Error()),
+		)
+		return err
+	}
+
+	svc := s3.New(sess, &aws.Config{
+		Region:       aws.String(tgt.Region),
+		UseDualStack: aws.Bool(cfg.Backends.S3.DualStack || opts.Network.IPFamily == familyIPv6),
+		MaxRetries:   aws.Int(0),
+		HTTPClient:   &http.Client{Transport: transportFor(opts.Network)},
+	})
+
+	xrayport.AWS(svc.Client, cfg.Backends.S3.options()...)
+
+	result, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(tgt.Bucket),
+		Key:    aws.String(object),
+	})
+
+	if err != nil {
+		fmt.Printf("obj error: %s for %v\n", err.Error(), object)
+		span.LogFields(
+			log.String("event", "obj error"),
+			log.String("error", err.Error()),
+		)
+		return err
+	}
+
+	// Make sure to close the body when done with it for S3 GetObject APIs or
+	// will leak connections.
+	defer result.Body.Close()
+
+	return readBody(ctx, span, object, result.Body)
+}
+
+// fetchS3V2 reads an object from an AWS S3 bucket with the AWS SDK for Go v2
+func fetchS3V2(ctx context.Context, span opentracing.Span, tgt checkTarget, opts checkOptions, object string) error {
+	awsCfg, err := awsV2Config(ctx, tgt.Region, opts.Network)
+	if err != nil {
+		fmt.Printf("config error: %v\n", err.Error())
+		span.LogFields(
+			log.String("event", "config error"),
+			log.String("error", err.Error()),
+		)
+		return err
+	}
+
+	xrayport.AWSV2(&awsCfg, cfg.Backends.S3.options()...)
+
+	svc := s3v2.NewFromConfig(awsCfg, func(o *s3v2.Options) {
+		o.UseDualstack = cfg.Backends.S3.DualStack || opts.Network.IPFamily == familyIPv6
+	})
+
+	result, err := svc.GetObject(ctx, &s3v2.GetObjectInput{
+		Bucket: awsv2.String(tgt.Bucket),
+		Key:    awsv2.String(object),
+	})
+
+	if err != nil {
+		fmt.Printf("obj error: %s for %v\n", err.Error(), object)
+		span.LogFields(
+			log.String("event", "obj error"),
+			log.String("error", err.Error()),
+		)
+		return err
+	}
+
+	defer result.Body.Close()
+
+	return readBody(ctx, span, object, result.Body)
+}
+
+// readBody reads an object's body to the end, recording the bytes read and the time
+// taken on the attempt's trace so transfer rate is reported apart from request latency
+func readBody(ctx context.Context, span opentracing.Span, object string, body io.Reader) error {
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, body)
+	if at := traceFromContext(ctx); at != nil {
+		at.bodyRead(n, time.Since(start))
+	}
+	if err != nil {
+		fmt.Printf("io error: %v for %v\n", err.Error(), object)
+		span.LogFields(
+			log.String("event", "io error"),
+			log.String("error", err.Error()),
+		)
+		return bodyReadError{err}
+	}
+
+	return nil
+}
+
+// gcsHTTPClient returns an HTTP client for Google Cloud Storage authorized with the configured
+// credentials file, or the default credentials when there isn't one, making requests with base
+func gcsHTTPClient(ctx context.Context, base http.RoundTripper) (*http.Client, error) {
+	var ts oauth2.TokenSource
+
+	if cfg.Credentials.GCPCredentialsFile == "" {
+		dts, err := google.DefaultTokenSource(ctx, cfg.Backends.GCS.Scope)
+		if err != nil {
+			return nil, err
+		}
+		ts = dts
+	} else {
+		data, err := ioutil.ReadFile(cfg.Credentials.GCPCredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		creds, err := google.CredentialsFromJSON(ctx, data, cfg.Backends.GCS.Scope)
 		if err != nil {
-			fmt.Printf("obj error: %s for %v\n", err.Error(), object)
-			span.SetTag("error", true)
-			span.LogFields(
-				log.String("event", "obj error"),
-				log.String("error", err.Error()),
-			)
-			return
+			return nil, err
 		}
+		ts = creds.TokenSource
+	}
+
+	return &http.Client{Transport: &oauth2.Transport{Source: ts, Base: base}}, nil
+}
 
-		// Make sure to close the body when done with it for S3 GetObject APIs or
-		// will leak connections.
-		defer result.Body.Close()
-
-		if _, err := io.Copy(ioutil.Discard, result.Body); err != nil {
-			fmt.Printf("io error: %v for %v\n", err.Error(), object)
-			span.SetTag("error", true)
-			span.LogFields(
-				log.String("event", "io error"),
-				log.String("error", err.Error()),
-			)
-			return
+// awsV2Config returns an AWS SDK v2 configuration for region using the configured static
+// credentials, or the default credential chain when there aren't any. Retries are left
+// to requestObject, as with the v1 SDK.
+func awsV2Config(ctx context.Context, region string, no networkOptions) (awsv2.Config, error) {
+	loadOpts := []func(*awsv2config.LoadOptions) error{
+		awsv2config.WithRegion(region),
+		awsv2config.WithHTTPClient(awsV2ClientFor(no)),
+		awsv2config.WithRetryer(func() awsv2.Retryer { return awsv2.NopRetryer{} }),
+	}
+	if cfg.Credentials.AWSAccessKeyID != "" {
+		creds := awsv2.Credentials{
+			AccessKeyID:     cfg.Credentials.AWSAccessKeyID,
+			SecretAccessKey: cfg.Credentials.AWSSecretAccessKey,
+			SessionToken:    cfg.Credentials.AWSSessionToken,
 		}
+		loadOpts = append(loadOpts, awsv2config.WithCredentialsProvider(awsv2.CredentialsProviderFunc(
+			func(context.Context) (awsv2.Credentials, error) { return creds, nil },
+		)))
+	}
+
+	awsCfg, err := awsv2config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return awsCfg, err
+	}
+	if major := no.httpMajor(); major != 0 {
+		awsCfg.HTTPClient = protocolClient{awsCfg.HTTPClient, major}
+	}
+	return awsCfg, nil
+}
+
+// awsSession returns an AWS session using the configured static credentials,
+// or the default credential chain when there aren't any
+func awsSession() (*session.Session, error) {
+	if cfg.Credentials.AWSAccessKeyID == "" {
+		return session.NewSession()
 	}
 
+	return session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(
+			cfg.Credentials.AWSAccessKeyID,
+			cfg.Credentials.AWSSecretAccessKey,
+			cfg.Credentials.AWSSessionToken,
+		),
+	})
 }
@@ -2,8 +2,15 @@ package objcheck
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
 )
 
 func TestCreateObjList(t *testing.T) {
@@ -78,11 +85,25 @@ func TestObjCheckRequestValidate(t *testing.T) {
 		t.Errorf("Incorrect error for bad service %v", err.Error())
 	}
 
+	ocr = &objCheckRequest{Service: "s3", Region: "ap-northeast-3", Pool: 10, Count: 1}
+	err = ocr.validate()
+	if err != nil {
+		t.Errorf("Unexpected error %v\n", err.Error())
+	}
+
 	ocr = &objCheckRequest{Service: "gcs", Region: "us-west-1", Pool: 10, Count: 1}
 	err = ocr.validate()
+	if err == nil {
+		t.Error("Missing error for bad service")
+	} else if err.Error() != "Bad service / region combination: gcs and us-west-1" {
+		t.Errorf("Incorrect error for bad service %v", err.Error())
+	}
+
+	ocr = &objCheckRequest{Service: "gcs", Region: "us-west-9", Pool: 10, Count: 1}
+	err = ocr.validate()
 	if err == nil {
 		t.Error("Missing error for bad region")
-	} else if err.Error() != "Bad region us-west-1" {
+	} else if err.Error() != "Bad region us-west-9" {
 		t.Errorf("Incorrect error for bad region %v", err.Error())
 	}
 
@@ -110,3 +131,99 @@ func TestObjCheckRequestValidate(t *testing.T) {
 		t.Errorf("Incorrect error for bad count %v", err.Error())
 	}
 }
+
+func TestObjCheckErrors(t *testing.T) {
+	tests := []struct {
+		body   string
+		status int
+		code   string
+		fields []string
+	}{
+		{`{"service": `, http.StatusBadRequest, "decode_error", nil},
+		{`{"service": "bb", "region": "us-west-9", "pool": 99, "count": 0}`, http.StatusUnprocessableEntity, "validation_error", []string{"service", "region", "pool", "count"}},
+		{`{"service": "s3", "region": "us-east1", "pool": 10, "count": 1}`, http.StatusUnprocessableEntity, "validation_error", []string{"region"}},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		ObjCheck(w, httptest.NewRequest("POST", "/", strings.NewReader(test.body)))
+
+		if w.Code != test.status {
+			t.Errorf("Status was %v instead of %v for %v", w.Code, test.status, test.body)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("Content type was %v for %v", ct, test.body)
+		}
+
+		var resp errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Error body didn't decode %v", err.Error())
+		}
+		if resp.Error != test.code {
+			t.Errorf("Error code was %v instead of %v", resp.Error, test.code)
+		}
+		if len(resp.Fields) != len(test.fields) {
+			t.Errorf("Got fields %v instead of %v", resp.Fields, test.fields)
+			continue
+		}
+		for i, fe := range resp.Fields {
+			if fe.Field != test.fields[i] {
+				t.Errorf("Field %v was %v instead of %v", i, fe.Field, test.fields[i])
+			}
+		}
+	}
+}
+
+func TestObjCheckTraceContext(t *testing.T) {
+	tracer, ok := opentracing.GlobalTracer().(*mocktracer.MockTracer)
+	if !ok {
+		t.Skip("Not using mocktracer")
+	}
+
+	caller := tracer.StartSpan("scheduler")
+	callerCtx := caller.Context().(mocktracer.MockSpanContext)
+	otHeaders := http.Header{}
+	if err := tracer.Inject(caller.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(otHeaders)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	tests := []struct {
+		headers  http.Header
+		format   string
+		parentID int
+		traceID  string
+	}{
+		{http.Header{}, "", 0, ""},
+		{otHeaders, "opentracing", callerCtx.SpanID, ""},
+		{http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}, "w3c", 0, "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{http.Header{"X-Amzn-Trace-Id": {"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"}}, "xray", 0, "5759e988bd862e3fe1be46a994272793"},
+		{http.Header{"Traceparent": {"00-00000000000000000000000000000000-00f067aa0ba902b7-01"}}, "", 0, ""},
+	}
+
+	for _, test := range tests {
+		tracer.Reset()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(`{"service": `))
+		r.Header = test.headers
+		ObjCheck(httptest.NewRecorder(), r)
+
+		spans := tracer.FinishedSpans()
+		if len(spans) != 1 || spans[0].OperationName != "ObjCheck" {
+			t.Errorf("Unexpected spans %v for %v", spans, test.headers)
+			continue
+		}
+		span := spans[0]
+		if span.ParentID != test.parentID {
+			t.Errorf("Parent was %v instead of %v for %v", span.ParentID, test.parentID, test.headers)
+		}
+		tags := span.Tags()
+		if tags["span.kind"] == nil || tags["http.method"] != "POST" || tags["http.status_code"] != uint16(http.StatusBadRequest) {
+			t.Errorf("Unexpected tags %v for %v", tags, test.headers)
+		}
+		if format, _ := tags["trace.propagation"].(string); format != test.format {
+			t.Errorf("Propagation was %v instead of %v", format, test.format)
+		}
+		if traceID, _ := tags["parent.trace_id"].(string); traceID != test.traceID {
+			t.Errorf("Parent trace was %v instead of %v", traceID, test.traceID)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package objcheck
+
+import (
+	"net"
+	"time"
+)
+
+// checkResult is the JSON body returned by ObjCheck for a completed check
+type checkResult struct {
+	Pool             int            `json:"pool"`
+	Count            int            `json:"count"`
+	Size             string         `json:"size"`
+	Parallel         bool           `json:"parallel"`
+	DurationMS       float64        `json:"duration_ms"`
+	DeadlineExceeded bool           `json:"deadline_exceeded"`
+	Connections      connSummary    `json:"connections"`
+	Targets          []targetResult `json:"targets"`
+	// Errors holds failures of the check that don't belong to a target
+	Errors []string `json:"errors,omitempty"`
+}
+
+// targetResult summarizes the object fetches against one target
+type targetResult struct {
+	Target    string `json:"target,omitempty"`
+	Service   string `json:"service"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Objects   int    `json:"objects"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	Timeouts  int    `json:"timeouts"`
+	Skipped   int    `json:"skipped"`
+	// Attempts counts every fetch attempt, RetriedObjects those objects needing more than one
+	Attempts       int              `json:"attempts"`
+	RetriedObjects int              `json:"retried_objects"`
+	RetryDelayMS   float64          `json:"retry_delay_ms"`
+	Retries        []objectAttempts `json:"retries,omitempty"`
+	// FailuresByClass counts failed objects by the class of their final error,
+	// AttemptErrorsByClass counts every failed attempt including those later retried
+	FailuresByClass      map[errorClass]int `json:"failures_by_class,omitempty"`
+	AttemptErrorsByClass map[errorClass]int `json:"attempt_errors_by_class,omitempty"`
+	DurationMS           float64            `json:"duration_ms"`
+	Latency              latencyMS          `json:"latency_ms"`
+	DNS                  dnsSummary         `json:"dns"`
+	TLS                  tlsSummary         `json:"tls"`
+	Transfer             transferSummary    `json:"transfer"`
+	Connections          connSummary        `json:"connections"`
+	IPFamilies           map[string]int     `json:"ip_families,omitempty"`
+	Protocols            map[string]int     `json:"protocols,omitempty"`
+	Errors               []string           `json:"errors,omitempty"`
+}
+
+// latencyMS summarizes the latency of successful object fetches in milliseconds
+type latencyMS struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	Max  float64 `json:"max"`
+}
+
+// dnsSummary aggregates the DNS lookups made while checking a target, with Addresses
+// counting how often each address was returned
+type dnsSummary struct {
+	Lookups   int            `json:"lookups"`
+	Failures  int            `json:"failures"`
+	MeanMS    float64        `json:"mean_ms"`
+	Addresses map[string]int `json:"addresses,omitempty"`
+}
+
+func (ds *dnsSummary) record(lookup dnsLookup) {
+	ds.MeanMS = (ds.MeanMS*float64(ds.Lookups) + lookup.DurationMS) / float64(ds.Lookups+1)
+	ds.Lookups++
+	if lookup.Error != "" {
+		ds.Failures++
+	}
+	for _, addr := range lookup.Addrs {
+		if ds.Addresses == nil {
+			ds.Addresses = make(map[string]int)
+		}
+		ds.Addresses[addr]++
+	}
+}
+
+// tlsSummary aggregates the TLS handshakes made while checking a target, with Versions
+// counting the protocol versions negotiated
+type tlsSummary struct {
+	Handshakes int            `json:"handshakes"`
+	Resumed    int            `json:"resumed"`
+	Failures   int            `json:"failures"`
+	MeanMS     float64        `json:"mean_ms"`
+	Versions   map[string]int `json:"versions,omitempty"`
+}
+
+func (ts *tlsSummary) record(hs tlsHandshake) {
+	ts.MeanMS = (ts.MeanMS*float64(ts.Handshakes) + hs.DurationMS) / float64(ts.Handshakes+1)
+	ts.Handshakes++
+	if hs.Resumed {
+		ts.Resumed++
+	}
+	if hs.Error != "" {
+		ts.Failures++
+	}
+	if hs.Version != "" {
+		if ts.Versions == nil {
+			ts.Versions = make(map[string]int)
+		}
+		ts.Versions[hs.Version]++
+	}
+}
+
+// transferSummary totals the response bodies read, with BytesPerSecond the throughput
+// over the time spent reading them
+type transferSummary struct {
+	Bytes          int64   `json:"bytes"`
+	ReadMS         float64 `json:"read_ms"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+func (ts *transferSummary) record(ar attemptResult) {
+	ts.Bytes += ar.BodyBytes
+	ts.ReadMS += ar.BodyMS
+	if ts.ReadMS > 0 {
+		ts.BytesPerSecond = float64(ts.Bytes) / (ts.ReadMS / 1000)
+	}
+}
+
+// connSummary counts the connections used for a set of attempts. Frontends counts the
+// distinct remote addresses, and ReuseRatio the share of attempts on a reused connection.
+type connSummary struct {
+	Attempts   int     `json:"attempts"`
+	Reused     int     `json:"reused"`
+	Distinct   int     `json:"distinct"`
+	Frontends  int     `json:"frontends"`
+	ReuseRatio float64 `json:"reuse_ratio"`
+
+	ids       map[uint64]bool
+	frontends map[string]bool
+}
+
+func (cs *connSummary) record(ar attemptResult) {
+	if ar.ConnID == 0 {
+		return
+	}
+	cs.add(map[uint64]bool{ar.ConnID: true}, map[string]bool{frontend(ar.RemoteAddr): true})
+	cs.Attempts++
+	if ar.Reused {
+		cs.Reused++
+	}
+	cs.ReuseRatio = float64(cs.Reused) / float64(cs.Attempts)
+}
+
+// merge adds the connections of another summary, counting a connection used by both only once
+func (cs *connSummary) merge(other connSummary) {
+	cs.add(other.ids, other.frontends)
+	cs.Attempts += other.Attempts
+	cs.Reused += other.Reused
+	if cs.Attempts > 0 {
+		cs.ReuseRatio = float64(cs.Reused) / float64(cs.Attempts)
+	}
+}
+
+func (cs *connSummary) add(ids map[uint64]bool, frontends map[string]bool) {
+	if cs.ids == nil {
+		cs.ids = make(map[uint64]bool)
+		cs.frontends = make(map[string]bool)
+	}
+	for id := range ids {
+		cs.ids[id] = true
+	}
+	for fe := range frontends {
+		cs.frontends[fe] = true
+	}
+	cs.Distinct, cs.Frontends = len(cs.ids), len(cs.frontends)
+}
+
+// frontend returns the host of a remote address, so connections to different ports of
+// the same server count as one frontend
+func frontend(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// objectAttempts lists the attempts made for an object that was retried
+type objectAttempts struct {
+	Object   string          `json:"object"`
+	Attempts []attemptResult `json:"attempts"`
+}
+
+// maxResultErrors caps how many error messages, and retried objects, are kept per target
+const maxResultErrors = 10
+
+func newTargetResult(tgt checkTarget) targetResult {
+	return targetResult{
+		Target:  tgt.Name,
+		Service: tgt.Service,
+		Region:  tgt.Region,
+		Bucket:  tgt.Bucket,
+	}
+}
+
+// record adds the outcome of one object fetch and its attempts to the target's totals
+func (tr *targetResult) record(object string, elapsed time.Duration, attempts []attemptResult, err error) {
+	tr.Objects++
+	tr.Attempts += len(attempts)
+	for _, ar := range attempts {
+		tr.RetryDelayMS += ar.DelayMS
+		tr.Connections.record(ar)
+		tr.Transfer.record(ar)
+		for _, lookup := range ar.DNS {
+			tr.DNS.record(lookup)
+		}
+		for _, hs := range ar.TLS {
+			tr.TLS.record(hs)
+		}
+		if ar.IPFamily != "" {
+			if tr.IPFamilies == nil {
+				tr.IPFamilies = make(map[string]int)
+			}
+			tr.IPFamilies[ar.IPFamily]++
+		}
+		if ar.Protocol != "" {
+			if tr.Protocols == nil {
+				tr.Protocols = make(map[string]int)
+			}
+			tr.Protocols[ar.Protocol]++
+		}
+		if ar.Outcome != "ok" {
+			if tr.AttemptErrorsByClass == nil {
+				tr.AttemptErrorsByClass = make(map[errorClass]int)
+			}
+			tr.AttemptErrorsByClass[ar.Class]++
+		}
+	}
+	if len(attempts) > 1 {
+		tr.RetriedObjects++
+		if len(tr.Retries) < maxResultErrors {
+			tr.Retries = append(tr.Retries, objectAttempts{object, attempts})
+		}
+	}
+
+	if err != nil {
+		class := classOther
+		if len(attempts) > 0 {
+			class = attempts[len(attempts)-1].Class
+		}
+		if tr.FailuresByClass == nil {
+			tr.FailuresByClass = make(map[errorClass]int)
+		}
+		tr.FailuresByClass[class]++
+		tr.Failed++
+		if _, ok := err.(timeoutError); ok {
+			tr.Timeouts++
+		}
+		if len(tr.Errors) < maxResultErrors {
+			tr.Errors = append(tr.Errors, err.Error())
+		}
+		return
+	}
+
+	ms := milliseconds(elapsed)
+	if tr.Succeeded == 0 || ms < tr.Latency.Min {
+		tr.Latency.Min = ms
+	}
+	if ms > tr.Latency.Max {
+		tr.Latency.Max = ms
+	}
+	tr.Latency.Mean = (tr.Latency.Mean*float64(tr.Succeeded) + ms) / float64(tr.Succeeded+1)
+	tr.Succeeded++
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// timeoutError marks a fetch that failed because the object timeout or the overall deadline passed
+type timeoutError struct {
+	err error
+}
+
+func (te timeoutError) Error() string {
+	return "timeout: " + te.err.Error()
+}
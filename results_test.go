@@ -0,0 +1,166 @@
+package objcheck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+func TestTargetResultRecord(t *testing.T) {
+	tr := newTargetResult(checkTarget{Service: "gcs", Region: "us-east1", Bucket: "objcheck-us-east1"})
+
+	retried := []attemptResult{
+		{Attempt: 1, Outcome: "error", Class: classHTTP, Status: 503, DelayMS: 100},
+		{Attempt: 2, Outcome: "ok"},
+	}
+
+	tr.record("10_1_1k.obj", 10*time.Millisecond, []attemptResult{{Attempt: 1, Outcome: "ok"}}, nil)
+	tr.record("10_2_1k.obj", 30*time.Millisecond, retried, nil)
+	tr.record("10_3_1k.obj", time.Second, []attemptResult{{Attempt: 1, Outcome: "error", Class: classTLS}}, errors.New("obj error"))
+	tr.record("10_4_1k.obj", time.Second, []attemptResult{{Attempt: 1, Outcome: "error", Class: classTimeout}}, timeoutError{context.DeadlineExceeded})
+
+	if tr.Objects != 4 || tr.Succeeded != 2 || tr.Failed != 2 || tr.Timeouts != 1 {
+		t.Errorf("Unexpected totals %+v", tr)
+	}
+	if tr.Latency.Min != 10 || tr.Latency.Max != 30 || tr.Latency.Mean != 20 {
+		t.Errorf("Unexpected latency %+v", tr.Latency)
+	}
+	if len(tr.Errors) != 2 {
+		t.Errorf("Unexpected errors %v", tr.Errors)
+	}
+	if tr.Attempts != 5 || tr.RetriedObjects != 1 || tr.RetryDelayMS != 100 {
+		t.Errorf("Unexpected attempt totals %+v", tr)
+	}
+	if tr.FailuresByClass[classTLS] != 1 || tr.FailuresByClass[classTimeout] != 1 || len(tr.FailuresByClass) != 2 {
+		t.Errorf("Unexpected failures by class %v", tr.FailuresByClass)
+	}
+	if tr.AttemptErrorsByClass[classHTTP] != 1 || len(tr.AttemptErrorsByClass) != 3 {
+		t.Errorf("Unexpected attempt errors by class %v", tr.AttemptErrorsByClass)
+	}
+	if len(tr.Retries) != 1 || tr.Retries[0].Object != "10_2_1k.obj" || len(tr.Retries[0].Attempts) != 2 {
+		t.Errorf("Unexpected retries %+v", tr.Retries)
+	}
+}
+
+func TestRunTargetCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tr := runTarget(ctx, checkTarget{Service: "gcs", Region: "us-east1", Bucket: "objcheck-us-east1"}, checkOptions{}, []string{"a", "b", "c"})
+	if tr.Skipped != 3 || tr.Objects != 0 {
+		t.Errorf("Canceled target wasn't skipped %+v", tr)
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	var ocr objCheckRequest
+	if err := json.Unmarshal([]byte(`{"object_timeout": "1.5s", "deadline": "1m"}`), &ocr); err != nil {
+		t.Fatalf("Unexpected error %v", err.Error())
+	}
+	if time.Duration(ocr.ObjectTimeout) != 1500*time.Millisecond || time.Duration(ocr.Deadline) != time.Minute {
+		t.Errorf("Durations decoded as %v and %v", ocr.ObjectTimeout, ocr.Deadline)
+	}
+
+	if err := json.Unmarshal([]byte(`{"deadline": 60}`), &ocr); err == nil {
+		t.Error("Missing error for numeric duration")
+	}
+
+	data, _ := json.Marshal(duration(2 * time.Second))
+	if string(data) != `"2s"` {
+		t.Errorf("Duration encoded as %s", data)
+	}
+}
+
+func TestConnSummary(t *testing.T) {
+	var a, b connSummary
+	a.record(attemptResult{ConnID: 1, RemoteAddr: "10.0.0.1:443"})
+	a.record(attemptResult{ConnID: 1, RemoteAddr: "10.0.0.1:443", Reused: true})
+	a.record(attemptResult{Outcome: "error"})
+	b.record(attemptResult{ConnID: 1, RemoteAddr: "10.0.0.1:443", Reused: true})
+	b.record(attemptResult{ConnID: 2, RemoteAddr: "[2001:db8::1]:443"})
+
+	if a.Attempts != 2 || a.Distinct != 1 || a.Frontends != 1 || a.ReuseRatio != 0.5 {
+		t.Errorf("Unexpected summary %+v", a)
+	}
+
+	var run connSummary
+	run.merge(a)
+	run.merge(b)
+	if run.Attempts != 4 || run.Reused != 2 || run.Distinct != 2 || run.Frontends != 2 || run.ReuseRatio != 0.5 {
+		t.Errorf("Unexpected merged summary %+v", run)
+	}
+}
+
+// fetchAttempt makes a request through rt with an attemptTrace and returns the attempt as
+// requestObject records it
+func fetchAttempt(t *testing.T, rt http.RoundTripper, url string) attemptResult {
+	at := &attemptTrace{}
+	ctx := at.withTrace(context.Background())
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer resp.Body.Close()
+	if err := readBody(ctx, opentracing.NoopTracer{}.StartSpan("requestObject"), "obj", resp.Body); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	conn := at.connection()
+	bodyBytes, bodyTime := at.body()
+	return attemptResult{
+		Attempt:    1,
+		Outcome:    "ok",
+		ConnID:     conn.ID,
+		RemoteAddr: conn.RemoteAddr,
+		Reused:     conn.Reused,
+		BodyBytes:  bodyBytes,
+		BodyMS:     milliseconds(bodyTime),
+		TLS:        at.tlsHandshakes(),
+	}
+}
+
+func TestTargetResultConnections(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	rt := newTransport(networkOptions{})
+	tr := newTargetResult(checkTarget{Service: "gcs", Region: "us-east1", Bucket: "objcheck-us-east1"})
+	for _, obj := range []string{"10_1_1k.obj", "10_2_1k.obj"} {
+		tr.record(obj, time.Millisecond, []attemptResult{fetchAttempt(t, rt, srv.URL)}, nil)
+	}
+
+	if tr.Connections.Attempts != 2 || tr.Connections.Reused != 1 || tr.Connections.Distinct != 1 || tr.Connections.Frontends != 1 || tr.Connections.ReuseRatio != 0.5 {
+		t.Errorf("Unexpected connections %+v", tr.Connections)
+	}
+}
+
+func TestTargetResultTransfer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 4096))
+	}))
+	defer srv.Close()
+
+	rt := newTransport(networkOptions{})
+	tr := newTargetResult(checkTarget{Service: "s3", Region: "us-east-1", Bucket: "objcheck-us-east-1"})
+	for _, obj := range []string{"10_1_4k.obj", "10_2_4k.obj"} {
+		tr.record(obj, time.Millisecond, []attemptResult{fetchAttempt(t, rt, srv.URL)}, nil)
+	}
+	tr.record("10_3_4k.obj", time.Millisecond, []attemptResult{{Attempt: 1, Outcome: "error", Class: classHTTP, Status: 503}}, errors.New("obj error"))
+
+	if tr.Transfer.Bytes != 8192 || tr.Transfer.ReadMS <= 0 || tr.Transfer.BytesPerSecond <= 0 {
+		t.Errorf("Unexpected transfer %+v", tr.Transfer)
+	}
+
+	data, _ := json.Marshal(tr)
+	if !strings.Contains(string(data), `"transfer":{"bytes":8192,`) {
+		t.Errorf("Missing transfer in %s", data)
+	}
+}
@@ -0,0 +1,214 @@
+package objcheck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// retryPolicy controls how ObjCheck retries a failed object fetch. The SDKs' own retries
+// are turned off so that every attempt against either backend is made and recorded here.
+type retryPolicy struct {
+	Disabled       bool     `json:"disabled"`
+	MaxAttempts    int      `json:"max_attempts"`
+	InitialBackoff duration `json:"initial_backoff"`
+	MaxBackoff     duration `json:"max_backoff"`
+	Multiplier     float64  `json:"multiplier"`
+	RetryOn        []string `json:"retry_on"`
+}
+
+// maxAttemptsLimit caps the attempts a policy can ask for
+const maxAttemptsLimit = 10
+
+// retryServer and retryNetwork are retry_on shorthands for HTTP 5xx failures and
+// for DNS, connect and TLS failures
+const (
+	retryServer  = "server"
+	retryNetwork = "network"
+)
+
+// retryClasses are what a policy can retry on, the error classes plus the shorthands
+var retryClasses = map[string]bool{
+	string(classDNS):      true,
+	string(classConnect):  true,
+	string(classTLS):      true,
+	string(classHTTP):     true,
+	string(classThrottle): true,
+	string(classTimeout):  true,
+	string(classBodyRead): true,
+	string(classOther):    true,
+	retryServer:           true,
+	retryNetwork:          true,
+}
+
+func defaultRetryPolicy() retryPolicy {
+	return retryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: duration(100 * time.Millisecond),
+		MaxBackoff:     duration(5 * time.Second),
+		Multiplier:     2,
+		RetryOn:        []string{string(classThrottle), retryServer, retryNetwork},
+	}
+}
+
+// validate checks the policy, field names are given the prefix
+func (rp retryPolicy) validate(prefix string) validationError {
+	var ve validationError
+
+	if rp.Disabled {
+		return ve
+	}
+
+	if rp.MaxAttempts < 1 || rp.MaxAttempts > maxAttemptsLimit {
+		ve = append(ve, fieldError{prefix + "max_attempts", fmt.Sprintf("Bad max attempts %v", rp.MaxAttempts)})
+	}
+
+	if rp.InitialBackoff < 0 || rp.MaxBackoff < rp.InitialBackoff {
+		ve = append(ve, fieldError{prefix + "max_backoff", fmt.Sprintf("Bad backoff %v to %v", rp.InitialBackoff, rp.MaxBackoff)})
+	}
+
+	if rp.Multiplier < 1 {
+		ve = append(ve, fieldError{prefix + "multiplier", fmt.Sprintf("Bad multiplier %v", rp.Multiplier)})
+	}
+
+	for _, class := range rp.RetryOn {
+		if !retryClasses[class] {
+			ve = append(ve, fieldError{prefix + "retry_on", fmt.Sprintf("Bad retry class %v", class)})
+		}
+	}
+
+	return ve
+}
+
+// shouldRetry reports whether a failed attempt should be tried again
+func (rp retryPolicy) shouldRetry(f failure, attempt int) bool {
+	if rp.Disabled || attempt >= rp.MaxAttempts {
+		return false
+	}
+	for _, on := range rp.RetryOn {
+		switch on {
+		case retryServer:
+			if f.Class == classHTTP && f.Status >= 500 {
+				return true
+			}
+		case retryNetwork:
+			if f.Class == classDNS || f.Class == classConnect || f.Class == classTLS {
+				return true
+			}
+		default:
+			if errorClass(on) == f.Class {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the attempt after the given one
+func (rp retryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(rp.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		delay *= rp.Multiplier
+		if delay >= float64(rp.MaxBackoff) {
+			return time.Duration(rp.MaxBackoff)
+		}
+	}
+	return time.Duration(delay)
+}
+
+// sleep waits for the delay, returning early with the context's error if it's done first
+func sleep(ctx context.Context, delay time.Duration) error {
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// attemptResult records the outcome of one attempt at fetching an object
+type attemptResult struct {
+	Attempt    int            `json:"attempt"`
+	Outcome    string         `json:"outcome"`
+	Class      errorClass     `json:"class,omitempty"`
+	Status     int            `json:"status,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	DurationMS float64        `json:"duration_ms"`
+	DelayMS    float64        `json:"delay_ms,omitempty"`
+	IPFamily   string         `json:"ip_family,omitempty"`
+	Protocol   string         `json:"protocol,omitempty"`
+	ConnID     uint64         `json:"conn_id,omitempty"`
+	RemoteAddr string         `json:"remote_addr,omitempty"`
+	Reused     bool           `json:"reused,omitempty"`
+	BodyBytes  int64          `json:"body_bytes,omitempty"`
+	BodyMS     float64        `json:"body_ms,omitempty"`
+	DNS        []dnsLookup    `json:"dns,omitempty"`
+	TLS        []tlsHandshake `json:"tls,omitempty"`
+}
+
+// statusError is returned by noRetryTransport in place of a throttled or failed response
+type statusError struct {
+	Code   int
+	Status string
+	Body   string
+}
+
+func (se *statusError) Error() string {
+	return fmt.Sprintf("HTTP status %v: %v", se.Status, se.Body)
+}
+
+// noRetryTransport stops the Cloud Storage client retrying on its own. It turns 429 and 5xx
+// responses into errors, and hides whether transport errors are temporary, because the
+// client only retries on googleapi.Error status codes and temporary errors. Body read
+// errors are wrapped too, since the client's reader reopens the object with a ranged
+// request when an HTTP/2 stream fails with INTERNAL_ERROR.
+type noRetryTransport struct {
+	base http.RoundTripper
+}
+
+// maxStatusBody caps how much of a failed response body is kept in a statusError
+const maxStatusBody = 1024
+
+func (nrt noRetryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := nrt.base.RoundTrip(r)
+	if err != nil {
+		return nil, attemptError{err}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxStatusBody))
+		resp.Body.Close()
+		return nil, &statusError{Code: resp.StatusCode, Status: resp.Status, Body: string(body)}
+	}
+
+	resp.Body = attemptBody{resp.Body}
+	return resp, nil
+}
+
+// attemptBody is a response body returning read errors other than io.EOF as attemptErrors
+type attemptBody struct {
+	io.ReadCloser
+}
+
+func (ab attemptBody) Read(p []byte) (int, error) {
+	n, err := ab.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = attemptError{err}
+	}
+	return n, err
+}
+
+// attemptError wraps a transport error without its Temporary and Timeout methods
+type attemptError struct {
+	err error
+}
+
+func (ae attemptError) Error() string {
+	return ae.err.Error()
+}
@@ -0,0 +1,308 @@
+package objcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	awsv2credentials "github.com/aws/aws-sdk-go-v2/credentials"
+	s3v2 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/smithy-go"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	rp := defaultRetryPolicy()
+	if ve := rp.validate(""); len(ve) != 0 {
+		t.Fatalf("Default policy invalid %v", ve)
+	}
+
+	delays := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}
+	for i, want := range delays {
+		if got := rp.backoff(i + 1); got != want {
+			t.Errorf("Backoff after attempt %v was %v instead of %v", i+1, got, want)
+		}
+	}
+	rp.MaxBackoff = duration(300 * time.Millisecond)
+	if got := rp.backoff(3); got != 300*time.Millisecond {
+		t.Errorf("Backoff wasn't capped %v", got)
+	}
+
+	if !rp.shouldRetry(failure{Class: classThrottle}, 1) || !rp.shouldRetry(failure{Class: classHTTP, Status: 502}, 3) {
+		t.Error("Policy should retry throttles and server errors")
+	}
+	if !rp.shouldRetry(failure{Class: classTLS}, 1) || !rp.shouldRetry(failure{Class: classDNS}, 1) {
+		t.Error("Policy should retry network errors")
+	}
+	if rp.shouldRetry(failure{Class: classHTTP, Status: 502}, 4) {
+		t.Error("Policy retried past max attempts")
+	}
+	if rp.shouldRetry(failure{Class: classHTTP, Status: 404}, 1) || rp.shouldRetry(failure{Class: classTimeout}, 1) {
+		t.Error("Policy retried a class it wasn't asked to")
+	}
+
+	rp.RetryOn = []string{"body_read"}
+	if !rp.shouldRetry(failure{Class: classBodyRead}, 1) || rp.shouldRetry(failure{Class: classThrottle}, 1) {
+		t.Error("Policy didn't retry on exactly the class asked for")
+	}
+
+	rp.Disabled = true
+	if rp.shouldRetry(failure{Class: classThrottle}, 1) {
+		t.Error("Disabled policy retried")
+	}
+
+	bad := retryPolicy{MaxAttempts: 20, InitialBackoff: duration(time.Second), MaxBackoff: duration(time.Millisecond), RetryOn: []string{"sunspots"}}
+	if ve := bad.validate("retry."); len(ve) != 4 {
+		t.Errorf("Unexpected errors for bad policy %v", ve)
+	}
+}
+
+func TestPartialRetryPolicy(t *testing.T) {
+	d := checkDefaults{Retry: defaultRetryPolicy()}
+	ocr, err := decodeRequest(strings.NewReader(`{"retry": {"max_attempts": 2, "retry_on": ["timeout"]}}`), d)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ocr.applyDefaults(d)
+	rp := *ocr.Retry
+	if ve := rp.validate("retry."); len(ve) != 0 {
+		t.Fatalf("Unexpected errors for partial policy %v", ve)
+	}
+	if rp.MaxAttempts != 2 || rp.Multiplier != 2 || rp.InitialBackoff != d.Retry.InitialBackoff || rp.MaxBackoff != d.Retry.MaxBackoff {
+		t.Errorf("Unexpected partial policy %+v", rp)
+	}
+	if len(rp.RetryOn) != 1 || rp.RetryOn[0] != "timeout" || d.Retry.RetryOn[0] != string(classThrottle) {
+		t.Errorf("Unexpected retry_on %v with default %v", rp.RetryOn, d.Retry.RetryOn)
+	}
+
+	ocr, err = decodeRequest(strings.NewReader(`{"retry": {"max_attempts": 3}}`), d)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !ocr.Retry.shouldRetry(failure{Class: classHTTP, Status: 503}, 1) {
+		t.Error("Partial policy lost the default retry_on")
+	}
+
+	ocr, err = decodeRequest(strings.NewReader(`{}`), d)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if ocr.Retry.MaxAttempts != d.Retry.MaxAttempts {
+		t.Errorf("Unexpected default policy %+v", ocr.Retry)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		err error
+		f   failure
+	}{
+		{nil, failure{Class: classNone}},
+		{&statusError{Code: 429}, failure{Class: classThrottle, Status: 429}},
+		{&statusError{Code: 502}, failure{Class: classHTTP, Status: 502}},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, failure{Class: classThrottle, Status: 403}},
+		{&googleapi.Error{Code: 404}, failure{Class: classHTTP, Status: 404}},
+		{attemptError{storage.ErrObjectNotExist}, failure{Class: classHTTP, Status: 404}},
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "id"), failure{Class: classThrottle, Status: 503}},
+		{awserr.NewRequestFailure(awserr.New("NoSuchKey", "missing", nil), 404, "id"), failure{Class: classHTTP, Status: 404}},
+		{s3V2Error(t, 503, "SlowDown"), failure{Class: classThrottle, Status: 503}},
+		{s3V2Error(t, 404, "NoSuchKey"), failure{Class: classHTTP, Status: 404}},
+		{s3V2Error(t, 500, "InternalError"), failure{Class: classHTTP, Status: 500}},
+		{&smithy.OperationError{Err: &url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}}, failure{Class: classConnect}},
+		{awserr.New("RequestError", "send request failed", &net.DNSError{Err: "no such host", Name: "s3.invalid"}), failure{Class: classDNS}},
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, failure{Class: classConnect}},
+		{&url.Error{Op: "Get", Err: tls.RecordHeaderError{Msg: "not TLS"}}, failure{Class: classTLS}},
+		{bodyReadError{io.ErrUnexpectedEOF}, failure{Class: classBodyRead}},
+		{timeoutError{errors.New("slow")}, failure{Class: classTimeout}},
+		{errors.New("odd"), failure{Class: classOther}},
+	}
+
+	for _, test := range tests {
+		if f := classify(ctx, test.err, nil); f != test.f {
+			t.Errorf("%v classified as %v instead of %v", test.err, f, test.f)
+		}
+	}
+
+	expired, cancel := context.WithTimeout(ctx, 0)
+	defer cancel()
+	<-expired.Done()
+	if f := classify(expired, errors.New("context deadline exceeded"), nil); f.Class != classTimeout {
+		t.Errorf("Expired context classified as %v", f)
+	}
+}
+
+// s3V2Error returns the error a v2 S3 client gets from GetObject for a response with
+// status and an S3 error code
+func s3V2Error(t *testing.T, status int, code string) error {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(status)
+		w.Write([]byte("<Error><Code>" + code + "</Code><Message>" + code + "</Message></Error>"))
+	}))
+	defer srv.Close()
+
+	svc := s3v2.NewFromConfig(awsv2.Config{
+		Region:      "us-east-1",
+		Credentials: awsv2credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		EndpointResolver: awsv2.EndpointResolverFunc(func(service, region string) (awsv2.Endpoint, error) {
+			return awsv2.Endpoint{URL: srv.URL, HostnameImmutable: true}, nil
+		}),
+		Retryer: func() awsv2.Retryer { return awsv2.NopRetryer{} },
+	}, func(o *s3v2.Options) {
+		o.UsePathStyle = true
+	})
+	_, err := svc.GetObject(context.Background(), &s3v2.GetObjectInput{Bucket: awsv2.String("objcheck-us-east-1"), Key: awsv2.String("10_1_1k.obj")})
+	if err == nil {
+		t.Fatalf("Missing error for %v %v", status, code)
+	}
+	return err
+}
+
+func TestClassifyPhases(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	tests := []struct {
+		url   string
+		class errorClass
+	}{
+		{srv.URL, classTLS},
+		{closed.URL, classConnect},
+	}
+
+	for _, test := range tests {
+		at := &attemptTrace{}
+		req, _ := http.NewRequest("GET", test.url, nil)
+		req = req.WithContext(at.withTrace(context.Background()))
+		_, err := http.DefaultClient.Do(req)
+		if err == nil {
+			t.Fatalf("Missing error for %v", test.url)
+		}
+		if at.failedPhase() != test.class {
+			t.Errorf("Failed phase for %v was %v instead of %v", test.url, at.failedPhase(), test.class)
+		}
+		if f := classify(context.Background(), err, at); f.Class != test.class {
+			t.Errorf("%v classified as %v instead of %v", err, f, test.class)
+		}
+	}
+}
+
+func TestNoRetryTransport(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("try later"))
+	}))
+	defer srv.Close()
+
+	c := &http.Client{Transport: noRetryTransport{http.DefaultTransport}}
+
+	_, err := c.Get(srv.URL)
+	if err == nil {
+		t.Fatal("Missing error for unavailable response")
+	}
+	if f := classify(context.Background(), err, nil); f.Class != classHTTP || f.Status != http.StatusServiceUnavailable {
+		t.Errorf("Unavailable response classified as %v", f)
+	}
+	if te, ok := err.(interface{ Temporary() bool }); ok && te.Temporary() {
+		t.Error("Error is temporary so the storage client would retry it")
+	}
+
+	status = http.StatusOK
+	resp, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err.Error())
+	}
+	resp.Body.Close()
+
+	srv.Close()
+	_, err = c.Get(srv.URL)
+	if f := classify(context.Background(), err, nil); f.Class != classConnect {
+		t.Errorf("Connection failure classified as %v", f)
+	}
+	if te, ok := err.(interface{ Temporary() bool }); ok && te.Temporary() {
+		t.Error("Error is temporary so the storage client would retry it")
+	}
+}
+
+// http2StreamError stands in for the HTTP/2 stream errors the storage reader retries on
+type http2StreamError struct{}
+
+func (http2StreamError) Error() string {
+	return "stream error: stream ID 1; INTERNAL_ERROR"
+}
+
+// failingBody returns some data and then an HTTP/2 stream error
+type failingBody struct {
+	sent bool
+}
+
+func (fb *failingBody) Read(p []byte) (int, error) {
+	if fb.sent {
+		return 0, http2StreamError{}
+	}
+	fb.sent = true
+	return copy(p, "da"), nil
+}
+
+func (fb *failingBody) Close() error {
+	return nil
+}
+
+// roundTripFunc is an http.RoundTripper calling a function
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestNoRetryTransportBody(t *testing.T) {
+	requests := 0
+	base := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests++
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Length": {"4"}},
+			ContentLength: 4,
+			Body:          &failingBody{},
+			Request:       r,
+		}, nil
+	})
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: noRetryTransport{base}}))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	rdr, err := client.Bucket("objcheck-us-central1").Object("10_1_1k.obj").NewReader(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer rdr.Close()
+
+	// The reader would otherwise reopen the object for the rest of the data
+	if _, err := ioutil.ReadAll(rdr); err == nil || !strings.Contains(err.Error(), "INTERNAL_ERROR") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Made %v requests instead of 1", requests)
+	}
+}
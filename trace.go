@@ -0,0 +1,228 @@
+package objcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+)
+
+// dnsLookup records one DNS resolution made during an attempt
+type dnsLookup struct {
+	Host       string   `json:"host"`
+	Addrs      []string `json:"addrs,omitempty"`
+	Coalesced  bool     `json:"coalesced,omitempty"`
+	DurationMS float64  `json:"duration_ms"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// tlsHandshake records one TLS handshake made during an attempt
+type tlsHandshake struct {
+	Version    string  `json:"version,omitempty"`
+	Resumed    bool    `json:"resumed,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// connInfo identifies the connection an attempt used
+type connInfo struct {
+	ID         uint64
+	RemoteAddr string
+	Reused     bool
+}
+
+// attemptTrace records what happened on the network during one fetch attempt, using
+// httptrace hooks that run alongside the ones xrayport uses for spans
+type attemptTrace struct {
+	mu       sync.Mutex
+	phase    errorClass
+	err      error
+	lookups  []dnsLookup
+	family   string
+	protocol string
+	tls      []tlsHandshake
+	conn     connInfo
+
+	bodyBytes int64
+	bodyTime  time.Duration
+
+	dnsHost  string
+	dnsStart time.Time
+	tlsStart time.Time
+}
+
+type attemptTraceKey struct{}
+
+// traceFromContext returns the attemptTrace installed by withTrace, if any
+func traceFromContext(ctx context.Context) *attemptTrace {
+	at, _ := ctx.Value(attemptTraceKey{}).(*attemptTrace)
+	return at
+}
+
+// withTrace returns a context whose HTTP requests report to at
+func (at *attemptTrace) withTrace(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, attemptTraceKey{}, at)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			at.mu.Lock()
+			at.dnsHost, at.dnsStart = info.Host, time.Now()
+			at.mu.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			at.dnsDone(info)
+			at.fail(classDNS, info.Err)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			at.fail(classConnect, err)
+		},
+		TLSHandshakeStart: func() {
+			at.mu.Lock()
+			at.tlsStart = time.Now()
+			at.mu.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			at.tlsDone(state, err)
+			at.fail(classTLS, err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			// A connection was made, so earlier failures such as one address of
+			// several not answering didn't fail the attempt
+			at.mu.Lock()
+			at.phase, at.err = "", nil
+			if info.Conn != nil {
+				at.family = xrayport.IPFamily(info.Conn.RemoteAddr().String())
+				at.protocol = connProtocol(info.Conn)
+				at.conn = connInfo{
+					ID:         xrayport.ConnID(info.Conn),
+					RemoteAddr: info.Conn.RemoteAddr().String(),
+					Reused:     info.Reused,
+				}
+			}
+			at.mu.Unlock()
+		},
+	})
+}
+
+func (at *attemptTrace) dnsDone(info httptrace.DNSDoneInfo) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	lookup := dnsLookup{
+		Host:       at.dnsHost,
+		Addrs:      addrStrings(info.Addrs),
+		Coalesced:  info.Coalesced,
+		DurationMS: milliseconds(time.Since(at.dnsStart)),
+	}
+	if info.Err != nil {
+		lookup.Error = info.Err.Error()
+	}
+	at.lookups = append(at.lookups, lookup)
+}
+
+func (at *attemptTrace) tlsDone(state tls.ConnectionState, err error) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	hs := tlsHandshake{
+		Version:    xrayport.TLSVersionName(state.Version),
+		Resumed:    state.DidResume,
+		DurationMS: milliseconds(time.Since(at.tlsStart)),
+	}
+	if err != nil {
+		hs.Error = err.Error()
+	}
+	at.tls = append(at.tls, hs)
+}
+
+// bodyRead records n bytes of response body read in d
+func (at *attemptTrace) bodyRead(n int64, d time.Duration) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.bodyBytes += n
+	at.bodyTime += d
+}
+
+func (at *attemptTrace) fail(phase errorClass, err error) {
+	if err == nil {
+		return
+	}
+	at.mu.Lock()
+	at.phase, at.err = phase, err
+	at.mu.Unlock()
+}
+
+// failedPhase returns the connection phase that last failed, if any
+func (at *attemptTrace) failedPhase() errorClass {
+	if at == nil {
+		return ""
+	}
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.phase
+}
+
+// dnsLookups returns the DNS resolutions made during the attempt
+func (at *attemptTrace) dnsLookups() []dnsLookup {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.lookups
+}
+
+// tlsHandshakes returns the TLS handshakes made during the attempt
+func (at *attemptTrace) tlsHandshakes() []tlsHandshake {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.tls
+}
+
+// ipFamily returns the IP family of the last connection the attempt used
+func (at *attemptTrace) ipFamily() string {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.family
+}
+
+// body returns the bytes of response body read during the attempt and the time taken
+func (at *attemptTrace) body() (int64, time.Duration) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.bodyBytes, at.bodyTime
+}
+
+// connection returns the last connection the attempt used
+func (at *attemptTrace) connection() connInfo {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.conn
+}
+
+// httpProtocol returns the HTTP protocol negotiated on the last connection the attempt used
+func (at *attemptTrace) httpProtocol() string {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.protocol
+}
+
+// connProtocol returns the ALPN protocol of a TLS connection, HTTP/1.1 when none was negotiated
+func connProtocol(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "http/1.1"
+	}
+	if p := tc.ConnectionState().NegotiatedProtocol; p != "" {
+		return p
+	}
+	return "http/1.1"
+}
+
+func addrStrings(addrs []net.IPAddr) []string {
+	var strs []string
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	return strs
+}
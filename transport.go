@@ -0,0 +1,270 @@
+package objcheck
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+const (
+	resolverGo = "go"
+
+	familyDual = "dual"
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+
+	httpAuto = "auto"
+	httpH1   = "h1"
+	httpH2   = "h2"
+)
+
+// networkOptions control how connections to the storage services are made. The zero
+// value uses http.DefaultTransport, so connections stay warm between invocations.
+type networkOptions struct {
+	// Resolver is "" for net.DefaultResolver, "go" for the pure Go resolver, or the
+	// host:port of a DNS server. The default is also the pure Go resolver on Linux, unless
+	// the binary uses cgo and GODEBUG=netdns=cgo is set, so there is no option for libc.
+	Resolver string `json:"resolver"`
+	// FreshDNS makes a new connection, and so a new lookup, for every request
+	FreshDNS bool `json:"fresh_dns"`
+	// IPFamily is "dual" to let the dialer choose, or "ipv4" or "ipv6" to force one
+	IPFamily string `json:"ip_family"`
+	// HTTPVersion is "auto" to negotiate, or "h1" or "h2" to require HTTP/1.1 or HTTP/2
+	HTTPVersion string `json:"http_version"`
+	// ColdTLS makes a new connection with a full TLS handshake, without session resumption,
+	// for every request
+	ColdTLS bool `json:"cold_tls"`
+}
+
+// validate checks the options, field names are given the prefix
+func (no networkOptions) validate(prefix string) validationError {
+	var ve validationError
+
+	switch no.Resolver {
+	case "", resolverGo:
+	default:
+		if _, _, err := net.SplitHostPort(no.Resolver); err != nil {
+			ve = append(ve, fieldError{prefix + "resolver", fmt.Sprintf("Bad resolver %v", no.Resolver)})
+		}
+	}
+
+	switch no.IPFamily {
+	case "", familyDual, familyIPv4, familyIPv6:
+	default:
+		ve = append(ve, fieldError{prefix + "ip_family", fmt.Sprintf("Bad IP family %v", no.IPFamily)})
+	}
+
+	switch no.HTTPVersion {
+	case "", httpAuto, httpH1, httpH2:
+	default:
+		ve = append(ve, fieldError{prefix + "http_version", fmt.Sprintf("Bad HTTP version %v", no.HTTPVersion)})
+	}
+
+	return ve
+}
+
+// dialContext returns a dial function that only uses the configured IP family
+func (no networkOptions) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	suffix := ""
+	switch no.IPFamily {
+	case familyIPv4:
+		suffix = "4"
+	case familyIPv6:
+		suffix = "6"
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" {
+			network += suffix
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// resolver returns the DNS resolver for the options
+func (no networkOptions) resolver() *net.Resolver {
+	switch no.Resolver {
+	case "":
+		return net.DefaultResolver
+	case resolverGo:
+		return &net.Resolver{PreferGo: true}
+	}
+
+	server := no.Resolver
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// maxTransports caps the transports kept for reuse, since requests can pick their own
+// resolver and so make any number of option sets
+const maxTransports = 16
+
+// cachedTransport holds the transport and AWS SDK v2 client kept for reuse with the
+// options they were made for, each is made when first asked for
+type cachedTransport struct {
+	no networkOptions
+	rt http.RoundTripper
+	v2 *awshttp.BuildableClient
+}
+
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[networkOptions]*list.Element)
+	// transportsLRU holds the cached transports, most recently used first
+	transportsLRU = list.New()
+)
+
+// transportFor returns the transport for a set of network options, reusing one made for an
+// earlier invocation with the same options so its idle connections can be used again.
+// Beyond maxTransports the least recently used transport is dropped and its idle
+// connections closed.
+func transportFor(no networkOptions) http.RoundTripper {
+	if no == (networkOptions{}) {
+		return http.DefaultTransport
+	}
+
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	ct := cachedFor(no)
+	if ct.rt == nil {
+		ct.rt = newTransport(no)
+	}
+	return ct.rt
+}
+
+// awsV2ClientFor returns the AWS SDK v2 HTTP client for a set of network options, reused
+// like the transports from transportFor. The SDK needs its own client type so it can add
+// a CA bundle from AWS_CA_BUNDLE or the shared config, and doesn't check the HTTP
+// version used, see awsV2Config.
+func awsV2ClientFor(no networkOptions) *awshttp.BuildableClient {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	ct := cachedFor(no)
+	if ct.v2 == nil {
+		ct.v2 = awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+			no.configure(t)
+		})
+	}
+	return ct.v2
+}
+
+// cachedFor returns the cache entry for a set of network options, adding it if there is
+// none and dropping the least recently used beyond maxTransports. transportsMu must be held.
+func cachedFor(no networkOptions) *cachedTransport {
+	if e, ok := transports[no]; ok {
+		transportsLRU.MoveToFront(e)
+		return e.Value.(*cachedTransport)
+	}
+
+	ct := &cachedTransport{no: no}
+	transports[no] = transportsLRU.PushFront(ct)
+	for transportsLRU.Len() > maxTransports {
+		old := transportsLRU.Remove(transportsLRU.Back()).(*cachedTransport)
+		delete(transports, old.no)
+		// The v2 client has no way to close its connections, they time out when idle
+		if ci, ok := old.rt.(interface{ CloseIdleConnections() }); ok {
+			ci.CloseIdleConnections()
+		}
+	}
+	return ct
+}
+
+// newTransport builds a transport for a set of network options
+func newTransport(no networkOptions) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	no.configure(t)
+	if major := no.httpMajor(); major != 0 {
+		return protocolTransport{t, major}
+	}
+	return t
+}
+
+// httpMajor returns the major HTTP version responses must use, or 0 for any
+func (no networkOptions) httpMajor() int {
+	switch no.HTTPVersion {
+	case httpH1:
+		return 1
+	case httpH2:
+		return 2
+	}
+	return 0
+}
+
+// configure sets up t for a set of network options
+func (no networkOptions) configure(t *http.Transport) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  no.resolver(),
+	}
+
+	t.DialContext = no.dialContext(dialer)
+	t.DisableKeepAlives = no.FreshDNS || no.ColdTLS
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.SessionTicketsDisabled = no.ColdTLS
+
+	switch no.HTTPVersion {
+	case httpH1:
+		// A non-nil empty TLSNextProto turns off HTTP/2
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		t.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	case httpH2:
+		t.ForceAttemptHTTP2 = true
+		t.TLSClientConfig.NextProtos = []string{"h2"}
+	default:
+		t.ForceAttemptHTTP2 = true
+	}
+}
+
+// protocolTransport fails requests answered over a different major HTTP version, since
+// a server that doesn't offer HTTP/2 over ALPN gets HTTP/1.1 even when only h2 is asked for
+type protocolTransport struct {
+	*http.Transport
+	major int
+}
+
+func (pt protocolTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return checkProtocol(r, pt.major)(pt.Transport.RoundTrip(r))
+}
+
+// protocolClient is protocolTransport for AWS SDK v2 clients
+type protocolClient struct {
+	awsv2.HTTPClient
+	major int
+}
+
+func (pc protocolClient) Do(r *http.Request) (*http.Response, error) {
+	return checkProtocol(r, pc.major)(pc.HTTPClient.Do(r))
+}
+
+// checkProtocol returns a function failing responses to r that don't use the major HTTP version
+func checkProtocol(r *http.Request, major int) func(*http.Response, error) (*http.Response, error) {
+	return func(resp *http.Response, err error) (*http.Response, error) {
+		if err != nil {
+			return nil, err
+		}
+		if resp.ProtoMajor != major {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%v %v: got %v instead of HTTP/%v", r.Method, r.URL.Host, resp.Proto, major)
+		}
+		return resp, nil
+	}
+}
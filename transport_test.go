@@ -0,0 +1,326 @@
+package objcheck
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	s3v2 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestNetworkOptionsValidate(t *testing.T) {
+	for _, resolver := range []string{"", "go", "8.8.8.8:53", "[2001:4860:4860::8888]:53"} {
+		if ve := (networkOptions{Resolver: resolver}).validate(""); len(ve) != 0 {
+			t.Errorf("Unexpected error for resolver %v: %v", resolver, ve)
+		}
+	}
+
+	if ve := (networkOptions{Resolver: "8.8.8.8"}).validate(""); len(ve) != 1 || ve[0].Field != "resolver" {
+		t.Errorf("Incorrect error for resolver without port %v", ve)
+	}
+
+	// The default resolver is usually Go's own, so there is no "system" resolver to pick
+	if ve := (networkOptions{Resolver: "system"}).validate(""); len(ve) != 1 || ve[0].Field != "resolver" {
+		t.Errorf("Incorrect error for system resolver %v", ve)
+	}
+}
+
+func TestTransportFor(t *testing.T) {
+	if transportFor(networkOptions{}) != http.DefaultTransport {
+		t.Error("Zero options didn't use the default transport")
+	}
+
+	fresh := networkOptions{Resolver: "go", FreshDNS: true}
+	tr := transportFor(fresh)
+	if tr != transportFor(fresh) {
+		t.Error("Transport wasn't reused for the same options")
+	}
+	if ht, ok := tr.(*http.Transport); !ok || !ht.DisableKeepAlives {
+		t.Error("Fresh DNS transport keeps connections alive")
+	}
+	if tr == transportFor(networkOptions{Resolver: "go"}) {
+		t.Error("Transport was shared between different options")
+	}
+
+	// Each resolver server gets its own transport, the least recently used are dropped
+	for i := 0; i < maxTransports; i++ {
+		transportFor(networkOptions{Resolver: fmt.Sprintf("10.0.0.%v:53", i)})
+	}
+	if tr == transportFor(fresh) {
+		t.Error("Least recently used transport was kept")
+	}
+	transportsMu.Lock()
+	cached, used := len(transports), transportsLRU.Len()
+	transportsMu.Unlock()
+	if cached != maxTransports || used != maxTransports {
+		t.Errorf("Cached %v transports instead of %v", cached, maxTransports)
+	}
+}
+
+func TestResolverServer(t *testing.T) {
+	r := networkOptions{Resolver: "127.0.0.1:1"}.resolver()
+	if _, err := r.LookupHost(context.Background(), "storage.googleapis.com"); err == nil {
+		t.Error("Lookup through an unreachable DNS server didn't fail")
+	}
+}
+
+func TestAttemptTraceDNS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	at := &attemptTrace{}
+	req, _ := http.NewRequest("GET", url, nil)
+	req = req.WithContext(at.withTrace(context.Background()))
+
+	resp, err := transportFor(networkOptions{Resolver: "go", FreshDNS: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err.Error())
+	}
+	resp.Body.Close()
+
+	lookups := at.dnsLookups()
+	if len(lookups) != 1 || lookups[0].Host != "localhost" || len(lookups[0].Addrs) == 0 {
+		t.Fatalf("Unexpected lookups %+v", lookups)
+	}
+
+	var ds dnsSummary
+	ds.record(lookups[0])
+	ds.record(dnsLookup{Host: "nowhere.invalid", Error: "no such host"})
+	if ds.Lookups != 2 || ds.Failures != 1 || len(ds.Addresses) != len(lookups[0].Addrs) {
+		t.Errorf("Unexpected summary %+v", ds)
+	}
+}
+
+func TestIPFamily(t *testing.T) {
+	if ve := (networkOptions{IPFamily: "ipv5"}).validate(""); len(ve) != 1 || ve[0].Field != "ip_family" {
+		t.Errorf("Incorrect error for bad IP family %v", ve)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	at := &attemptTrace{}
+	req, _ := http.NewRequest("GET", url, nil)
+	req = req.WithContext(at.withTrace(context.Background()))
+	resp, err := transportFor(networkOptions{IPFamily: "ipv4"}).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err.Error())
+	}
+	resp.Body.Close()
+	if at.ipFamily() != "ipv4" {
+		t.Errorf("Connection family was %v instead of ipv4", at.ipFamily())
+	}
+
+	// The test server only listens on IPv4, so forcing IPv6 has to fail
+	req, _ = http.NewRequest("GET", url, nil)
+	if resp, err := transportFor(networkOptions{IPFamily: "ipv6"}).RoundTrip(req); err == nil {
+		resp.Body.Close()
+		t.Error("IPv6 connection to an IPv4 server didn't fail")
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	if ve := (networkOptions{HTTPVersion: "h3"}).validate(""); len(ve) != 1 || ve[0].Field != "http_version" {
+		t.Errorf("Incorrect error for bad HTTP version %v", ve)
+	}
+
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h1 := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer h1.Close()
+
+	tests := []struct {
+		version string
+		srv     *httptest.Server
+		proto   string
+		fails   bool
+	}{
+		{"auto", h2, "h2", false},
+		{"h1", h2, "http/1.1", false},
+		{"h2", h2, "h2", false},
+		{"auto", h1, "http/1.1", false},
+		{"h2", h1, "", true},
+	}
+	for _, test := range tests {
+		rt := newTransport(networkOptions{HTTPVersion: test.version})
+		ht, ok := rt.(*http.Transport)
+		if pt, isProto := rt.(protocolTransport); isProto {
+			ht, ok = pt.Transport, true
+		}
+		if !ok {
+			t.Fatalf("Unexpected transport %T", rt)
+		}
+		ht.TLSClientConfig.RootCAs = test.srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+		at := &attemptTrace{}
+		req, _ := http.NewRequest("GET", test.srv.URL, nil)
+		resp, err := rt.RoundTrip(req.WithContext(at.withTrace(context.Background())))
+		if test.fails {
+			if err == nil {
+				t.Errorf("Missing error for %v against %v", test.version, test.proto)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if p := at.httpProtocol(); p != test.proto {
+			t.Errorf("Incorrect protocol for %v: %v instead of %v", test.version, p, test.proto)
+		}
+	}
+}
+
+func TestAWSV2Config(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	// The SDK can only add a CA bundle to its own client type
+	f, err := ioutil.TempFile("", "ca-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	f.Close()
+
+	env := map[string]string{
+		"AWS_CA_BUNDLE":         f.Name(),
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+	}
+	for k, v := range env {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		defer func(k, old string, ok bool) {
+			if ok {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		}(k, old, ok)
+	}
+
+	for _, version := range []string{"auto", "h2"} {
+		awsCfg, err := awsV2Config(context.Background(), "us-east-1", networkOptions{HTTPVersion: version})
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		awsCfg.EndpointResolver = awsv2.EndpointResolverFunc(func(service, region string) (awsv2.Endpoint, error) {
+			return awsv2.Endpoint{URL: srv.URL, HostnameImmutable: true}, nil
+		})
+		svc := s3v2.NewFromConfig(awsCfg, func(o *s3v2.Options) {
+			o.UsePathStyle = true
+		})
+		out, err := svc.GetObject(context.Background(), &s3v2.GetObjectInput{Bucket: awsv2.String("objcheck-us-east-1"), Key: awsv2.String("10_1_1k.obj")})
+
+		// The test server only speaks HTTP/1.1
+		if version == "h2" {
+			if err == nil || !strings.Contains(err.Error(), "instead of HTTP/2") {
+				t.Errorf("Unexpected error for h2 %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		out.Body.Close()
+	}
+}
+
+func TestColdTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	rt := newTransport(networkOptions{ColdTLS: true})
+	ht := rt.(*http.Transport)
+	if !ht.DisableKeepAlives || !ht.TLSClientConfig.SessionTicketsDisabled {
+		t.Fatal("Cold TLS transport can reuse connections or sessions")
+	}
+	ht.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	tr := newTargetResult(checkTarget{Service: "gcs", Region: "us-east1", Bucket: "objcheck-us-east1"})
+	for _, obj := range []string{"10_1_1k.obj", "10_2_1k.obj"} {
+		tr.record(obj, time.Millisecond, []attemptResult{fetchAttempt(t, rt, srv.URL)}, nil)
+	}
+	if ts := tr.TLS; ts.Handshakes != 2 || ts.Resumed != 0 || ts.Failures != 0 || ts.Versions["TLS 1.3"] != 2 {
+		t.Errorf("Unexpected summary %+v", ts)
+	}
+}
+
+func TestAttemptTraceConnection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	rt := newTransport(networkOptions{Resolver: "go"})
+	var conns []connInfo
+	for i := 0; i < 2; i++ {
+		at := &attemptTrace{}
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		resp, err := rt.RoundTrip(req.WithContext(at.withTrace(context.Background())))
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		conns = append(conns, at.connection())
+	}
+
+	if conns[0].ID == 0 || conns[0].Reused || conns[0].RemoteAddr != srv.Listener.Addr().String() {
+		t.Errorf("Unexpected first connection %+v", conns[0])
+	}
+	if conns[1].ID != conns[0].ID || !conns[1].Reused {
+		t.Errorf("Connection wasn't reused %+v", conns[1])
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 4096))
+	}))
+	defer srv.Close()
+
+	tracer := mocktracer.New()
+	root := tracer.StartSpan("requestObject")
+	ctx := opentracing.ContextWithSpan(context.Background(), root)
+
+	at := &attemptTrace{}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := http.DefaultTransport.RoundTrip(req.WithContext(at.withTrace(ctx)))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer resp.Body.Close()
+
+	body := xrayport.Body(ctx, resp.Body)
+	if err := readBody(at.withTrace(ctx), root, "obj", body); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if n, d := at.body(); n != 4096 || d <= 0 {
+		t.Errorf("Unexpected body read %v in %v", n, d)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 || spans[0].OperationName != "read_body" || spans[0].Tag("bytes") != int64(4096) || spans[0].Tag("complete") != true {
+		t.Errorf("Unexpected spans %+v", spans)
+	}
+}
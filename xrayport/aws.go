@@ -10,17 +10,19 @@ package xrayport
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http/httptrace"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-xray-sdk-go/resources"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	"github.com/opentracing/opentracing-go/log"
@@ -38,25 +40,94 @@ type jsonMap struct {
 	object interface{}
 }
 
-const (
-	requestKeyword = iota
-	responseKeyword
-)
+type awsSpansKey struct{}
+
+// awsSpans holds the spans of one AWS request: the operation span and the stack of
+// subsegment spans open beneath it. It lives on the request's context, so concurrent
+// requests never share it, and is locked because handlers may run on other goroutines.
+// When a sampler has to decide on the built request, the root isn't started until then
+// and start keeps when the request began.
+type awsSpans struct {
+	mu     sync.Mutex
+	root   opentracing.Span
+	stack  []opentracing.Span
+	config *clientConfig
+	start  time.Time
+}
+
+// requestSpans returns the spans of r, or nil when it isn't traced or hasn't been decided yet
+func requestSpans(r *request.Request) *awsSpans {
+	if as := pendingSpans(r); as != nil && as.started() {
+		return as
+	}
+	return nil
+}
+
+// pendingSpans returns the spans of r, whether its root is started or not
+func pendingSpans(r *request.Request) *awsSpans {
+	as, _ := r.HTTPRequest.Context().Value(awsSpansKey{}).(*awsSpans)
+	return as
+}
+
+func (as *awsSpans) started() bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.root != nil
+}
+
+// startRoot starts the operation span beneath the span in r's context, and the marshal
+// span beneath it, both from when the request began
+func (as *awsSpans) startRoot(r *request.Request) {
+	span, ctx := opentracing.StartSpanFromContext(r.HTTPRequest.Context(), r.ClientInfo.ServiceName, opentracing.StartTime(as.start))
+	span.SetTag("namespace", "aws")
+	as.mu.Lock()
+	as.root = span
+	as.mu.Unlock()
+	r.HTTPRequest = r.HTTPRequest.WithContext(ctx)
 
-var simpleParents = make(map[opentracing.Span]opentracing.Span)
-var rootCheck = make(map[opentracing.Span]bool) // XXX hacky hack
+	beginSubsegment(r, "marshal", opentracing.StartTime(as.start))
+}
 
-func beginSubsegment(r *request.Request, name string) {
-	parentSpan := opentracing.SpanFromContext(r.HTTPRequest.Context())
-	span, ctx := opentracing.StartSpanFromContext(r.HTTPRequest.Context(), name)
+func (as *awsSpans) push(span opentracing.Span) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.stack = append(as.stack, span)
+}
 
-	simpleParents[span] = parentSpan
+// pop removes the innermost open subsegment span, returning it and the span that becomes current
+func (as *awsSpans) pop() (span, parent opentracing.Span) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if len(as.stack) == 0 {
+		return nil, as.root
+	}
+	span = as.stack[len(as.stack)-1]
+	as.stack = as.stack[:len(as.stack)-1]
+	parent = as.root
+	if len(as.stack) > 0 {
+		parent = as.stack[len(as.stack)-1]
+	}
+	return span, parent
+}
+
+func beginSubsegment(r *request.Request, name string, opts ...opentracing.StartSpanOption) {
+	as := requestSpans(r)
+	if as == nil {
+		return
+	}
+	span, ctx := opentracing.StartSpanFromContext(r.HTTPRequest.Context(), name, opts...)
+
+	as.push(span)
 	// ctx, _ := BeginSubsegment(r.HTTPRequest.Context(), name)
 	r.HTTPRequest = r.HTTPRequest.WithContext(ctx)
 }
 
 func endSubsegment(r *request.Request) {
-	span := opentracing.SpanFromContext(r.HTTPRequest.Context())
+	as := requestSpans(r)
+	if as == nil {
+		return
+	}
+	span, parent := as.pop()
 
 	if span == nil {
 		return
@@ -75,66 +146,77 @@ func endSubsegment(r *request.Request) {
 	// }
 	// seg.Close(r.Error)
 
-	parent := simpleParents[span]
-	delete(simpleParents, span)
-
 	ctx := opentracing.ContextWithSpan(r.HTTPRequest.Context(), parent)
 
 	r.HTTPRequest = r.HTTPRequest.WithContext(ctx)
 }
 
-var xRayBeforeValidateHandler = request.NamedHandler{
-	Name: "XRayBeforeValidateHandler",
-	Fn: func(r *request.Request) {
-		span, ctx := opentracing.StartSpanFromContext(r.HTTPRequest.Context(), r.ClientInfo.ServiceName)
-
-		if span == nil {
-			return
-		}
-
-		rootCheck[span] = true
-
-		// ctx, opseg := BeginSubsegment(r.HTTPRequest.Context(), r.ClientInfo.ServiceName)
-		// if opseg == nil {
-		// 	return
-		// }
-		// opseg.Namespace = "aws"
-
-		marshalSpan, marshalctx := opentracing.StartSpanFromContext(ctx, "marshal")
-
-		simpleParents[marshalSpan] = span
+func xRayBeforeValidateHandler(config *clientConfig) request.NamedHandler {
+	return request.NamedHandler{
+		Name: "XRayBeforeValidateHandler",
+		Fn: func(r *request.Request) {
+			ctx := r.HTTPRequest.Context()
+			if notSampled(ctx) {
+				return
+			}
 
-		// marshalctx, _ := BeginSubsegment(ctx, "marshal")
+			as := &awsSpans{config: config, start: time.Now()}
+			r.HTTPRequest = r.HTTPRequest.WithContext(context.WithValue(ctx, awsSpansKey{}, as))
 
-		r.HTTPRequest = r.HTTPRequest.WithContext(marshalctx)
+			// A sampler decides once the request is built, before that the URL is the
+			// operation's template and doesn't carry the bucket or key
+			if _, decided := SamplingDecision(ctx); decided || config.sampler == nil {
+				as.startRoot(r)
+			}
+		},
+	}
+}
 
-		_ = inject(opentracing.GlobalTracer(), span, r.HTTPRequest.Header)
+func xRayAfterBuildHandler(config *clientConfig) request.NamedHandler {
+	return request.NamedHandler{
+		Name: "XRayAfterBuildHandler",
+		Fn: func(r *request.Request) {
+			if as := pendingSpans(r); as != nil && !as.started() {
+				ctx, sampled := decide(r.HTTPRequest.Context(), config.sampler, SamplingRequest{
+					Host:      r.HTTPRequest.URL.Host,
+					Method:    r.HTTPRequest.Method,
+					URLPath:   r.HTTPRequest.URL.Path,
+					Service:   r.ClientInfo.ServiceName,
+					Operation: r.Operation.Name,
+				})
+				r.HTTPRequest = r.HTTPRequest.WithContext(ctx)
+				if sampled {
+					as.startRoot(r)
+				}
+			}
 
-		// r.HTTPRequest.Header.Set(TraceIDHeaderKey, opseg.DownstreamHeader().String())
-	},
-}
+			as := requestSpans(r)
+			if as == nil {
+				ctx := r.HTTPRequest.Context()
+				config.injectNotSampled(opentracing.SpanFromContext(ctx), r.HTTPRequest.Header)
+				return
+			}
 
-var xRayAfterBuildHandler = request.NamedHandler{
-	Name: "XRayAfterBuildHandler",
-	Fn: func(r *request.Request) {
-		endSubsegment(r)
-	},
+			endSubsegment(r) // end marshal subsegment
+			_ = config.inject(as.root, r.HTTPRequest.Header)
+		},
+	}
 }
 
 var xRayBeforeSignHandler = request.NamedHandler{
 	Name: "XRayBeforeSignHandler",
 	Fn: func(r *request.Request) {
-		parent := opentracing.SpanFromContext(r.HTTPRequest.Context())
-		span, ctx := opentracing.StartSpanFromContext(r.HTTPRequest.Context(), "attempt")
-		if span == nil {
+		as := requestSpans(r)
+		if as == nil {
 			return
 		}
-		simpleParents[span] = parent
+		beginSubsegment(r, "attempt")
+		ctx := r.HTTPRequest.Context()
 		// ctx, seg := BeginSubsegment(r.HTTPRequest.Context(), "attempt")
 		// if seg == nil {
 		// 	return
 		// }
-		ct, _ := NewClientTrace(ctx)
+		ct, _ := newClientTrace(ctx, as.config.granularity)
 		r.HTTPRequest = r.HTTPRequest.WithContext(httptrace.WithClientTrace(ctx, ct.httpTrace))
 	},
 }
@@ -177,6 +259,9 @@ var xRayBeforeUnmarshalHandler = request.NamedHandler{
 	Name: "XRayBeforeUnmarshalHandler",
 	Fn: func(r *request.Request) {
 		endSubsegment(r) // end attempt subsegment
+		if r.HTTPResponse != nil {
+			r.HTTPResponse.Body = Body(r.HTTPRequest.Context(), r.HTTPResponse.Body)
+		}
 		beginSubsegment(r, "unmarshal")
 	},
 }
@@ -192,12 +277,8 @@ var xRayBeforeRetryHandler = request.NamedHandler{
 	Name: "XRayBeforeRetryHandler",
 	Fn: func(r *request.Request) {
 		endSubsegment(r) // end attempt subsegment
-		parent := opentracing.SpanFromContext(r.HTTPRequest.Context())
-		span, ctx := opentracing.StartSpanFromContext(r.HTTPRequest.Context(), "wait")
-		simpleParents[span] = parent
+		beginSubsegment(r, "wait")
 		// ctx, _ := BeginSubsegment(r.HTTPRequest.Context(), "wait")
-
-		r.HTTPRequest = r.HTTPRequest.WithContext(ctx)
 	},
 }
 
@@ -208,9 +289,9 @@ var xRayAfterRetryHandler = request.NamedHandler{
 	},
 }
 
-func pushHandlers(c *client.Client) {
-	c.Handlers.Validate.PushFrontNamed(xRayBeforeValidateHandler)
-	c.Handlers.Build.PushBackNamed(xRayAfterBuildHandler)
+func pushHandlers(c *client.Client, config *clientConfig) {
+	c.Handlers.Validate.PushFrontNamed(xRayBeforeValidateHandler(config))
+	c.Handlers.Build.PushBackNamed(xRayAfterBuildHandler(config))
 	c.Handlers.Sign.PushFrontNamed(xRayBeforeSignHandler)
 	c.Handlers.Send.PushBackNamed(xRayAfterSendHandler)
 	c.Handlers.Unmarshal.PushFrontNamed(xRayBeforeUnmarshalHandler)
@@ -220,20 +301,20 @@ func pushHandlers(c *client.Client) {
 }
 
 // AWS adds X-Ray tracing to an AWS client.
-func AWS(c *client.Client) {
+func AWS(c *client.Client, opts ...ClientOption) {
 	if c == nil {
 		panic("Please initialize the provided AWS client before passing to the AWS() method.")
 	}
-	pushHandlers(c)
+	pushHandlers(c, newClientConfig(opts))
 	c.Handlers.Complete.PushFrontNamed(xrayCompleteHandler(""))
 }
 
 // AWSWithWhitelist allows a custom parameter whitelist JSON file to be defined.
-func AWSWithWhitelist(c *client.Client, filename string) {
+func AWSWithWhitelist(c *client.Client, filename string, opts ...ClientOption) {
 	if c == nil {
 		panic("Please initialize the provided AWS client before passing to the AWSWithWhitelist() method.")
 	}
-	pushHandlers(c)
+	pushHandlers(c, newClientConfig(opts))
 	c.Handlers.Complete.PushFrontNamed(xrayCompleteHandler(filename))
 }
 
@@ -248,18 +329,17 @@ func xrayCompleteHandler(filename string) request.NamedHandler {
 	return request.NamedHandler{
 		Name: "XRayCompleteHandler",
 		Fn: func(r *request.Request) {
-			span := opentracing.SpanFromContext(r.HTTPRequest.Context())
-
-			for span != nil && !rootCheck[span] {
-				span.Finish()
-				parent := simpleParents[span]
-				delete(simpleParents, span)
-				span = parent
+			as := requestSpans(r)
+			if as == nil {
+				return
 			}
 
-			if span == nil {
-				return
+			var span opentracing.Span
+			for span, _ = as.pop(); span != nil; span, _ = as.pop() {
+				span.Finish()
 			}
+			span = as.root
+			r.HTTPRequest = r.HTTPRequest.WithContext(opentracing.ContextWithSpan(r.HTTPRequest.Context(), span))
 
 			// curseg := GetSegment(r.HTTPRequest.Context())
 
@@ -273,6 +353,13 @@ func xrayCompleteHandler(filename string) request.NamedHandler {
 
 			// opseg := curseg
 
+			for k, v := range extractRequestParameters(r, whitelist) {
+				setParameterTag(span, k, v)
+			}
+			for k, v := range extractResponseParameters(r, whitelist) {
+				setParameterTag(span, k, v)
+			}
+
 			// opseg.Lock()
 			// for k, v := range extractRequestParameters(r, whitelist) {
 			// 	opseg.GetAWS()[strings.ToLower(addUnderScoreBetweenWords(k))] = v
@@ -294,6 +381,7 @@ func xrayCompleteHandler(filename string) request.NamedHandler {
 			if r.HTTPResponse != nil {
 				ext.HTTPStatusCode.Set(span, uint16(r.HTTPResponse.StatusCode)) // XXX Castin' like C
 				span.SetTag("ContentLength", int(r.HTTPResponse.ContentLength))
+				span.SetTag("http.protocol", r.HTTPResponse.Proto)
 
 				// opseg.GetHTTP().GetResponse().Status = r.HTTPResponse.StatusCode
 				// opseg.GetHTTP().GetResponse().ContentLength = int(r.HTTPResponse.ContentLength)
@@ -316,8 +404,6 @@ func xrayCompleteHandler(filename string) request.NamedHandler {
 			}
 
 			span.Finish()
-
-			delete(rootCheck, span)
 			// opseg.Close(r.Error)
 		},
 	}
@@ -333,11 +419,23 @@ func parseWhitelistJSON(filename string) []byte {
 		}
 	}
 
-	defaultBytes, err := resources.Asset("resources/AWSWhitelist.json")
-	if err != nil {
-		panic(err)
+	return []byte(defaultWhitelistJSON)
+}
+
+// setParameterTag tags span with a whitelisted parameter, named in snake case as X-Ray
+// names it, dereferencing the pointers the SDK uses for values and skipping unset ones
+func setParameterTag(span opentracing.Span, name string, value interface{}) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return
 	}
-	return defaultBytes
+	span.SetTag(strings.ToLower(addUnderScoreBetweenWords(name)), v.Interface())
 }
 
 func keyValue(r interface{}, tag string) interface{} {
@@ -347,9 +445,10 @@ func keyValue(r interface{}, tag string) interface{} {
 	}
 	if v.Kind() != reflect.Struct {
 		// logger.Errorf("keyValue only accepts structs; got %T", v)
+		return nil
 	}
 	typ := v.Type()
-	for i := 1; i < v.NumField(); i++ {
+	for i := 0; i < v.NumField(); i++ {
 		if typ.Field(i).Name == tag {
 			return v.Field(i).Interface()
 		}
@@ -407,25 +506,26 @@ func (j *jsonMap) childrenMap() (map[string]interface{}, error) {
 }
 
 func extractRequestParameters(r *request.Request, whitelist *jsonMap) map[string]interface{} {
-	valueMap := make(map[string]interface{})
-
-	extractParameters("request_parameters", requestKeyword, r, whitelist, valueMap)
-	extractDescriptors("request_descriptors", requestKeyword, r, whitelist, valueMap)
-
-	return valueMap
+	return whitelistParameters("request", r.ClientInfo.ServiceName, r.Operation.Name, r.Params, whitelist)
 }
 
 func extractResponseParameters(r *request.Request, whitelist *jsonMap) map[string]interface{} {
+	return whitelistParameters("response", r.ClientInfo.ServiceName, r.Operation.Name, r.Data, whitelist)
+}
+
+// whitelistParameters extracts the whitelisted request or response parameters, as kind
+// says, of a service operation from its input or output data
+func whitelistParameters(kind, service, operation string, data interface{}, whitelist *jsonMap) map[string]interface{} {
 	valueMap := make(map[string]interface{})
 
-	extractParameters("response_parameters", responseKeyword, r, whitelist, valueMap)
-	extractDescriptors("response_descriptors", responseKeyword, r, whitelist, valueMap)
+	extractParameters(kind+"_parameters", service, operation, data, whitelist, valueMap)
+	extractDescriptors(kind+"_descriptors", service, operation, data, whitelist, valueMap)
 
 	return valueMap
 }
 
-func extractParameters(whitelistKey string, rType int, r *request.Request, whitelist *jsonMap, valueMap map[string]interface{}) {
-	params := whitelist.search("services", r.ClientInfo.ServiceName, "operations", r.Operation.Name, whitelistKey)
+func extractParameters(whitelistKey, service, operation string, data interface{}, whitelist *jsonMap, valueMap map[string]interface{}) {
+	params := whitelist.search("services", service, "operations", operation, whitelistKey)
 	if params != nil {
 		children, err := params.children()
 		if err != nil {
@@ -434,12 +534,7 @@ func extractParameters(whitelistKey string, rType int, r *request.Request, white
 		}
 		for _, child := range children {
 			if child != nil {
-				var value interface{}
-				if rType == requestKeyword {
-					value = keyValue(r.Params, child.(string))
-				} else if rType == responseKeyword {
-					value = keyValue(r.Data, child.(string))
-				}
+				value := keyValue(data, child.(string))
 				if (value != reflect.Value{}) {
 					valueMap[child.(string)] = value
 				}
@@ -448,8 +543,8 @@ func extractParameters(whitelistKey string, rType int, r *request.Request, white
 	}
 }
 
-func extractDescriptors(whitelistKey string, rType int, r *request.Request, whitelist *jsonMap, valueMap map[string]interface{}) {
-	responseDtr := whitelist.search("services", r.ClientInfo.ServiceName, "operations", r.Operation.Name, whitelistKey)
+func extractDescriptors(whitelistKey, service, operation string, data interface{}, whitelist *jsonMap, valueMap map[string]interface{}) {
+	responseDtr := whitelist.search("services", service, "operations", operation, whitelistKey)
 	if responseDtr != nil {
 		items, err := responseDtr.childrenMap()
 		if err != nil {
@@ -457,12 +552,8 @@ func extractDescriptors(whitelistKey string, rType int, r *request.Request, whit
 			return
 		}
 		for k := range items {
-			descriptorMap, _ := whitelist.search("services", r.ClientInfo.ServiceName, "operations", r.Operation.Name, whitelistKey, k).childrenMap()
-			if rType == requestKeyword {
-				insertDescriptorValuesIntoMap(k, r.Params, descriptorMap, valueMap)
-			} else if rType == responseKeyword {
-				insertDescriptorValuesIntoMap(k, r.Data, descriptorMap, valueMap)
-			}
+			descriptorMap, _ := whitelist.search("services", service, "operations", operation, whitelistKey, k).childrenMap()
+			insertDescriptorValuesIntoMap(k, data, descriptorMap, valueMap)
 		}
 	}
 }
@@ -501,7 +592,9 @@ func insertDescriptorValuesIntoMap(key string, data interface{}, descriptorMap m
 		var count int
 		l := keyValue(data, key)
 		val := reflect.ValueOf(l)
-		count = val.Len()
+		if val.Kind() == reflect.Slice || val.Kind() == reflect.Map {
+			count = val.Len()
+		}
 
 		if descriptorMap["rename_to"] != nil {
 			valueMap[descriptorMap["rename_to"].(string)] = count
@@ -0,0 +1,235 @@
+package xrayport_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+// newS3 returns an S3 client for a test server with path style bucket addressing
+func newS3(t *testing.T, url string) *s3.S3 {
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(url),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	return s3.New(sess)
+}
+
+func TestAWSConcurrentRequests(t *testing.T) {
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := path.Base(r.URL.Path)
+		w.Header().Set("X-Amz-Request-Id", "req-"+key)
+		w.Write([]byte("data-" + key))
+	}))
+	defer srv.Close()
+
+	svc := newS3(t, srv.URL)
+	xrayport.AWS(svc.Client)
+
+	const requests = 8
+	roots := make(map[int]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		key := fmt.Sprintf("10_%v_1k.obj", i)
+		root := tracer.StartSpan("requestObject")
+		roots[root.(*mocktracer.MockSpan).SpanContext.SpanID] = key
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer root.Finish()
+			ctx := opentracing.ContextWithSpan(context.Background(), root)
+			out, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String("objcheck-us-east-1"), Key: aws.String(key)})
+			if err != nil {
+				mu.Lock()
+				t.Errorf("Unexpected error %v", err)
+				mu.Unlock()
+				return
+			}
+			data, _ := ioutil.ReadAll(out.Body)
+			out.Body.Close()
+			if string(data) != "data-"+key {
+				mu.Lock()
+				t.Errorf("Read %q for %v", data, key)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	spans := tracer.FinishedSpans()
+	ops := make(map[int]*mocktracer.MockSpan)
+	for _, span := range spans {
+		if span.OperationName != "s3" {
+			continue
+		}
+		key, ok := roots[span.ParentID]
+		if !ok {
+			t.Errorf("Operation span isn't a child of a request %+v", span)
+			continue
+		}
+		if span.Tag("key") != key || span.Tag("RequestID") != "req-"+key {
+			t.Errorf("Operation span for %v has tags %v", key, span.Tags())
+		}
+		ops[span.SpanContext.SpanID] = span
+	}
+	if len(ops) != requests {
+		t.Fatalf("Got %v operation spans instead of %v", len(ops), requests)
+	}
+
+	// Each operation has exactly its own marshal, attempt and unmarshal spans
+	children := make(map[int]map[string]int)
+	for _, span := range spans {
+		switch span.OperationName {
+		case "marshal", "attempt", "unmarshal":
+			if ops[span.ParentID] == nil {
+				t.Errorf("%v span isn't a child of an operation span", span.OperationName)
+				continue
+			}
+			if children[span.ParentID] == nil {
+				children[span.ParentID] = make(map[string]int)
+			}
+			children[span.ParentID][span.OperationName]++
+		}
+	}
+	for id, op := range ops {
+		c := children[id]
+		if c["marshal"] != 1 || c["attempt"] != 1 || c["unmarshal"] != 1 {
+			t.Errorf("Operation for %v has subsegments %v", op.Tag("key"), c)
+		}
+	}
+}
+
+func TestAWSWhitelist(t *testing.T) {
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("list-type") == "2" {
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(`<ListBucketResult><Name>objcheck-us-east-1</Name><KeyCount>2</KeyCount><Contents><Key>10_1_1k.obj</Key></Contents><Contents><Key>10_2_1k.obj</Key></Contents></ListBucketResult>`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Amz-Meta-Pool", "10")
+		w.Header().Set("X-Amz-Meta-Size", "1k")
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	getObject := func(svc *s3.S3) *mocktracer.MockSpan {
+		tracer.Reset()
+		out, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String("objcheck-us-east-1"), Key: aws.String("10_1_1k.obj")})
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		ioutil.ReadAll(out.Body)
+		out.Body.Close()
+		return operationSpan(t, tracer)
+	}
+
+	// The default whitelist tags the bucket, key and content length of GetObject
+	svc := newS3(t, srv.URL)
+	xrayport.AWS(svc.Client)
+	tags := getObject(svc).Tags()
+	if tags["bucket_name"] != "objcheck-us-east-1" || tags["key"] != "10_1_1k.obj" || tags["content_length"] != int64(4) {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+
+	whitelist := `{
+		"services": {
+			"s3": {
+				"operations": {
+					"GetObject": {
+						"request_parameters": ["Key", "VersionId"],
+						"request_descriptors": {"Bucket": {"value": true, "rename_to": "bucket"}},
+						"response_parameters": ["ContentType"],
+						"response_descriptors": {"Metadata": {"map": true, "get_keys": true, "rename_to": "metadata_keys"}}
+					},
+					"ListObjectsV2": {
+						"request_descriptors": {"Prefix": {"value": true}},
+						"response_descriptors": {"Contents": {"list": true, "get_count": true}}
+					}
+				}
+			}
+		}
+	}`
+	f, err := ioutil.TempFile("", "whitelist")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(whitelist)
+	f.Close()
+
+	svc = newS3(t, srv.URL)
+	xrayport.AWSWithWhitelist(svc.Client, f.Name())
+	tags = getObject(svc).Tags()
+	if tags["bucket"] != "objcheck-us-east-1" || tags["key"] != "10_1_1k.obj" || tags["content_type"] != "text/plain" {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+	if _, ok := tags["version_id"]; ok {
+		t.Errorf("Unset parameter was tagged %v", tags)
+	}
+	if _, ok := tags["bucket_name"]; ok {
+		t.Errorf("Renamed parameter kept its name %v", tags)
+	}
+	keys, _ := tags["metadata_keys"].([]interface{})
+	found := make(map[string]bool)
+	for _, k := range keys {
+		found[fmt.Sprint(k)] = true
+	}
+	if len(keys) != 2 || !found["Pool"] || !found["Size"] {
+		t.Errorf("Unexpected metadata keys %v", tags["metadata_keys"])
+	}
+
+	tracer.Reset()
+	if _, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("objcheck-us-east-1"), Prefix: aws.String("10_")}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	tags = operationSpan(t, tracer).Tags()
+	if tags["contents"] != 2 || tags["prefix"] != "10_" || tags["operation"] != "ListObjectsV2" {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+}
+
+// operationSpan returns the one finished AWS operation span
+func operationSpan(t *testing.T, tracer *mocktracer.MockTracer) *mocktracer.MockSpan {
+	var op *mocktracer.MockSpan
+	for _, span := range tracer.FinishedSpans() {
+		if span.Tag("namespace") == "aws" {
+			if op != nil {
+				t.Fatal("Unexpected second operation span")
+			}
+			op = span
+		}
+	}
+	if op == nil {
+		t.Fatal("Missing operation span")
+	}
+	return op
+}
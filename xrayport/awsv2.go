@@ -0,0 +1,382 @@
+package xrayport
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// AWSV2 adds tracing to the AWS SDK for Go v2 clients made from cfg. Operations get the
+// same spans as with AWS: an operation span named for the service, with marshal, attempt,
+// wait and unmarshal spans beneath it and the HTTP phases beneath each attempt.
+func AWSV2(cfg *aws.Config, opts ...ClientOption) {
+	cfg.APIOptions = append(cfg.APIOptions, awsV2Middleware(parseWhitelist(""), newClientConfig(opts)))
+}
+
+// AWSV2WithWhitelist is AWSV2 with a custom parameter whitelist JSON file.
+func AWSV2WithWhitelist(cfg *aws.Config, filename string, opts ...ClientOption) {
+	cfg.APIOptions = append(cfg.APIOptions, awsV2Middleware(parseWhitelist(filename), newClientConfig(opts)))
+}
+
+func parseWhitelist(filename string) *jsonMap {
+	whitelist := &jsonMap{}
+	if err := json.Unmarshal(parseWhitelistJSON(filename), &whitelist.object); err != nil {
+		panic(err)
+	}
+	return whitelist
+}
+
+type awsV2SpansKey struct{}
+
+// awsV2Spans holds the spans of one v2 operation, like awsSpans does for v1 requests.
+// The operation span is the root, and the open subsegment spans are kept by name since
+// v2 middleware can't rewrite the context seen by the steps outside it. When a sampler
+// has to decide on the built request, the root isn't started until then and the start
+// of the operation and marshalling are kept for it.
+type awsV2Spans struct {
+	mu           sync.Mutex
+	root         opentracing.Span
+	config       *clientConfig
+	service      string
+	operation    string
+	start        time.Time
+	marshalStart time.Time
+	open         map[string]opentracing.Span
+	attempts     int
+	lastAttempt  time.Time
+	// The retry middleware drops the metadata of each attempt, so the last response
+	// and request ID are kept here for the operation span
+	response  *smithyhttp.Response
+	requestID string
+}
+
+// v2Spans returns the spans of the operation in ctx, or nil when it isn't traced or
+// hasn't been decided yet
+func v2Spans(ctx context.Context) *awsV2Spans {
+	if as := pendingV2Spans(ctx); as != nil && as.root != nil {
+		return as
+	}
+	return nil
+}
+
+// pendingV2Spans returns the spans of the operation in ctx, whether its root is started or not
+func pendingV2Spans(ctx context.Context) *awsV2Spans {
+	as, _ := ctx.Value(awsV2SpansKey{}).(*awsV2Spans)
+	return as
+}
+
+// startRoot starts the operation span beneath the span in ctx
+func (as *awsV2Spans) startRoot(ctx context.Context, opts ...opentracing.StartSpanOption) context.Context {
+	span, ctx := opentracing.StartSpanFromContext(ctx, as.service, opts...)
+	span.SetTag("namespace", "aws")
+	as.root = span
+	return ctx
+}
+
+// begin starts the named subsegment span beneath the operation span
+func (as *awsV2Spans) begin(ctx context.Context, name string, opts ...opentracing.StartSpanOption) context.Context {
+	opts = append(opts, opentracing.ChildOf(as.root.Context()))
+	span := as.root.Tracer().StartSpan(name, opts...)
+
+	as.mu.Lock()
+	as.open[name] = span
+	as.mu.Unlock()
+	return opentracing.ContextWithSpan(ctx, span)
+}
+
+// end finishes the named subsegment span if it is open, marking any error
+func (as *awsV2Spans) end(name string, err error) {
+	as.mu.Lock()
+	span := as.open[name]
+	delete(as.open, name)
+	as.mu.Unlock()
+
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.SetTag("error", true)
+		span.LogFields(log.String("errors", err.Error()))
+	}
+	span.Finish()
+}
+
+// endAll finishes every open subsegment span
+func (as *awsV2Spans) endAll() {
+	as.mu.Lock()
+	open := as.open
+	as.open = make(map[string]opentracing.Span)
+	as.mu.Unlock()
+
+	for _, span := range open {
+		span.Finish()
+	}
+}
+
+// awsV2Middleware returns the API option adding the tracing middleware to a v2 operation stack
+func awsV2Middleware(whitelist *jsonMap, config *clientConfig) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		op := middleware.InitializeMiddlewareFunc("XRayOperation", func(
+			ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+		) (middleware.InitializeOutput, middleware.Metadata, error) {
+			return handleV2Operation(ctx, in, next, whitelist, config)
+		})
+		// The service metadata is registered first so the operation span can be named for it
+		if err := stack.Initialize.Insert(op, "RegisterServiceMetadata", middleware.After); err != nil {
+			if err := stack.Initialize.Add(op, middleware.After); err != nil {
+				return err
+			}
+		}
+
+		if err := stack.Serialize.Add(xRayV2BeforeSerialize, middleware.Before); err != nil {
+			return err
+		}
+		if err := stack.Build.Add(xRayV2AfterSerialize(config), middleware.Before); err != nil {
+			return err
+		}
+		if err := stack.Finalize.Insert(xRayV2Attempt, "Retry", middleware.After); err != nil {
+			if err := stack.Finalize.Add(xRayV2Attempt, middleware.Before); err != nil {
+				return err
+			}
+		}
+		if err := stack.Deserialize.Add(xRayV2AfterUnmarshal, middleware.Before); err != nil {
+			return err
+		}
+		return stack.Deserialize.Add(xRayV2BeforeUnmarshal, middleware.After)
+	}
+}
+
+func handleV2Operation(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler, whitelist *jsonMap, config *clientConfig) (
+	middleware.InitializeOutput, middleware.Metadata, error,
+) {
+	service := v2ServiceName(awsmiddleware.GetServiceID(ctx))
+	operation := awsmiddleware.GetOperationName(ctx)
+
+	if notSampled(ctx) {
+		return next.HandleInitialize(ctx, in)
+	}
+
+	as := &awsV2Spans{config: config, service: service, operation: operation, start: time.Now(), open: make(map[string]opentracing.Span)}
+	// A sampler decides once the request is built and its host and path are known
+	if _, decided := SamplingDecision(ctx); decided || config.sampler == nil {
+		ctx = as.startRoot(ctx)
+	}
+	ctx = context.WithValue(ctx, awsV2SpansKey{}, as)
+
+	out, metadata, err := next.HandleInitialize(ctx, in)
+
+	span := as.root
+	if span == nil {
+		return out, metadata, err
+	}
+	as.endAll()
+
+	for k, v := range whitelistParameters("request", service, operation, in.Parameters, whitelist) {
+		setParameterTag(span, k, v)
+	}
+	if err == nil {
+		for k, v := range whitelistParameters("response", service, operation, out.Result, whitelist) {
+			setParameterTag(span, k, v)
+		}
+	}
+
+	span.SetTag("region", awsmiddleware.GetRegion(ctx))
+	span.SetTag("operation", operation)
+	as.mu.Lock()
+	attempts, resp, requestID := as.attempts, as.response, as.requestID
+	as.mu.Unlock()
+	if attempts > 0 {
+		span.SetTag("retries", attempts-1)
+	}
+	span.SetTag("RequestID", requestID)
+
+	if resp != nil {
+		ext.HTTPStatusCode.Set(span, uint16(resp.StatusCode)) // XXX Castin' like C
+		span.SetTag("ContentLength", int(resp.ContentLength))
+		span.SetTag("http.protocol", resp.Proto)
+
+		if extendedRequestID := resp.Header.Get(S3ExtendedRequestIDHeaderKey); extendedRequestID != "" {
+			span.SetTag("ExtendedRequestID", extendedRequestID)
+		}
+	}
+
+	if isV2Throttle(err) {
+		span.SetTag("Throttle", true)
+	}
+
+	if err != nil {
+		span.SetTag("error", true)
+		span.LogFields(log.String("errors", err.Error()))
+	}
+
+	span.Finish()
+	return out, metadata, err
+}
+
+var xRayV2BeforeSerialize = middleware.SerializeMiddlewareFunc("XRayBeforeSerialize", func(
+	ctx context.Context, in middleware.SerializeInput, next middleware.SerializeHandler,
+) (middleware.SerializeOutput, middleware.Metadata, error) {
+	if as := v2Spans(ctx); as != nil {
+		ctx = as.begin(ctx, "marshal")
+	} else if as := pendingV2Spans(ctx); as != nil {
+		as.marshalStart = time.Now()
+	}
+	return next.HandleSerialize(ctx, in)
+})
+
+func xRayV2AfterSerialize(config *clientConfig) middleware.BuildMiddleware {
+	return middleware.BuildMiddlewareFunc("XRayAfterSerialize", func(
+		ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler,
+	) (middleware.BuildOutput, middleware.Metadata, error) {
+		req, _ := in.Request.(*smithyhttp.Request)
+		as := pendingV2Spans(ctx)
+		if as != nil && as.root == nil {
+			var sampled bool
+			ctx, sampled = as.decide(ctx, req)
+			if !sampled {
+				as = nil
+			}
+		}
+		if as == nil {
+			if notSampled(ctx) && req != nil {
+				config.injectNotSampled(opentracing.SpanFromContext(ctx), req.Header)
+			}
+			return next.HandleBuild(ctx, in)
+		}
+
+		as.end("marshal", nil)
+		ctx = opentracing.ContextWithSpan(ctx, as.root)
+		if req != nil {
+			_ = config.inject(as.root, req.Header)
+		}
+		return next.HandleBuild(ctx, in)
+	})
+}
+
+// decide makes the sampling decision for an operation on its built request, and starts
+// the operation and marshal spans from their recorded start when it is to trace
+func (as *awsV2Spans) decide(ctx context.Context, req *smithyhttp.Request) (context.Context, bool) {
+	sr := SamplingRequest{Service: as.service, Operation: as.operation}
+	if req != nil {
+		sr.Host, sr.Method, sr.URLPath = req.URL.Host, req.Method, req.URL.Path
+	}
+	ctx, sampled := decide(ctx, as.config.sampler, sr)
+	if !sampled {
+		return ctx, false
+	}
+
+	as.startRoot(ctx, opentracing.StartTime(as.start))
+	if !as.marshalStart.IsZero() {
+		as.begin(ctx, "marshal", opentracing.StartTime(as.marshalStart))
+	}
+	return ctx, true
+}
+
+// xRayV2Attempt runs once per attempt inside the retry loop, the time since the previous
+// attempt ended is the retry delay and is recorded as a wait span
+var xRayV2Attempt = middleware.FinalizeMiddlewareFunc("XRayAttempt", func(
+	ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler,
+) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	as := v2Spans(ctx)
+	if as == nil {
+		return next.HandleFinalize(ctx, in)
+	}
+
+	as.mu.Lock()
+	as.attempts++
+	lastAttempt := as.lastAttempt
+	as.mu.Unlock()
+	if !lastAttempt.IsZero() {
+		as.begin(ctx, "wait", opentracing.StartTime(lastAttempt))
+		as.end("wait", nil)
+	}
+
+	ctx = as.begin(ctx, "attempt")
+	ct, _ := newClientTrace(ctx, as.config.granularity)
+	ctx = httptrace.WithClientTrace(ctx, ct.httpTrace)
+
+	out, metadata, err := next.HandleFinalize(ctx, in)
+
+	// The attempt span is normally ended before unmarshalling, unless the attempt
+	// failed before a response arrived
+	as.end("attempt", err)
+	as.mu.Lock()
+	as.lastAttempt = time.Now()
+	as.mu.Unlock()
+	return out, metadata, err
+})
+
+var xRayV2BeforeUnmarshal = middleware.DeserializeMiddlewareFunc("XRayBeforeUnmarshal", func(
+	ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler,
+) (middleware.DeserializeOutput, middleware.Metadata, error) {
+	out, metadata, err := next.HandleDeserialize(ctx, in)
+
+	as := v2Spans(ctx)
+	if as == nil {
+		return out, metadata, err
+	}
+	as.end("attempt", err) // end attempt subsegment
+	if resp, ok := out.RawResponse.(*smithyhttp.Response); ok && resp != nil {
+		resp.Body = Body(opentracing.ContextWithSpan(ctx, as.root), resp.Body)
+		as.mu.Lock()
+		as.response = resp
+		as.mu.Unlock()
+	}
+	if err == nil {
+		as.begin(ctx, "unmarshal")
+	}
+	return out, metadata, err
+})
+
+var xRayV2AfterUnmarshal = middleware.DeserializeMiddlewareFunc("XRayAfterUnmarshal", func(
+	ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler,
+) (middleware.DeserializeOutput, middleware.Metadata, error) {
+	out, metadata, err := next.HandleDeserialize(ctx, in)
+
+	if as := v2Spans(ctx); as != nil {
+		as.end("unmarshal", err)
+		if requestID, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+			as.mu.Lock()
+			as.requestID = requestID
+			as.mu.Unlock()
+		}
+	}
+	return out, metadata, err
+})
+
+// v2ServiceName returns the v1 service name for a v2 service ID, such as "s3" for "S3" and
+// "dynamodb" for "DynamoDB", so spans and the whitelist use the same names for both SDKs
+func v2ServiceName(serviceID string) string {
+	return strings.ToLower(strings.Replace(serviceID, " ", "", -1))
+}
+
+// isV2Throttle reports whether err carries an AWS error code the v1 SDK counts as
+// throttling, or S3's SlowDown
+func isV2Throttle(err error) bool {
+	for err != nil {
+		if apiErr, ok := err.(smithy.APIError); ok {
+			code := apiErr.ErrorCode()
+			return code == "SlowDown" || request.IsErrorThrottle(awserr.New(code, "", nil))
+		}
+		unwrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = unwrapper.Unwrap()
+	}
+	return false
+}
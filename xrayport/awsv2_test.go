@@ -0,0 +1,122 @@
+package xrayport_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	s3v2 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+// noBackoff retries at once
+type noBackoff struct{}
+
+func (noBackoff) BackoffDelay(attempt int, err error) (time.Duration, error) {
+	return 0, nil
+}
+
+// newS3V2 returns an S3 config for a test server that retries without waiting
+func newS3V2(url string) awsv2.Config {
+	return awsv2.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		EndpointResolver: awsv2.EndpointResolverFunc(func(service, region string) (awsv2.Endpoint, error) {
+			return awsv2.Endpoint{URL: url, HostnameImmutable: true}, nil
+		}),
+		Retryer: func() awsv2.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.Backoff = noBackoff{}
+			})
+		},
+	}
+}
+
+func TestAWSV2(t *testing.T) {
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	// The first request fails with a 503 so the SDK retries once
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+			return
+		}
+		w.Header().Set("X-Amz-Request-Id", "req-2")
+		w.Header().Set("X-Amz-Id-2", "ext-2")
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	cfg := newS3V2(srv.URL)
+	xrayport.AWSV2(&cfg)
+	svc := s3v2.NewFromConfig(cfg, func(o *s3v2.Options) {
+		o.UsePathStyle = true
+	})
+
+	root := tracer.StartSpan("requestObject")
+	ctx := opentracing.ContextWithSpan(context.Background(), root)
+	out, err := svc.GetObject(ctx, &s3v2.GetObjectInput{Bucket: awsv2.String("objcheck-us-east-1"), Key: awsv2.String("10_1_1k.obj")})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ioutil.ReadAll(out.Body)
+	out.Body.Close()
+	root.Finish()
+
+	op := operationSpan(t, tracer)
+	if op.ParentID != root.(*mocktracer.MockSpan).SpanContext.SpanID || op.OperationName != "s3" {
+		t.Errorf("Unexpected operation span %+v", op)
+	}
+	tags := op.Tags()
+	if tags["operation"] != "GetObject" || tags["region"] != "us-east-1" || tags["retries"] != 1 || tags["RequestID"] != "req-2" || tags["ExtendedRequestID"] != "ext-2" || tags["http.status_code"] != uint16(200) {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+	if tags["key"] != "10_1_1k.obj" || tags["bucket_name"] != "objcheck-us-east-1" {
+		t.Errorf("Missing whitelisted parameters in %v", tags)
+	}
+
+	var children []*mocktracer.MockSpan
+	for _, span := range tracer.FinishedSpans() {
+		if span.ParentID == op.SpanContext.SpanID && span.OperationName != "read_body" {
+			children = append(children, span)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].StartTime.Before(children[j].StartTime) })
+	var names []string
+	for _, span := range children {
+		names = append(names, span.OperationName)
+	}
+	// The error response of the first attempt is unmarshalled before the SDK retries
+	expected := []string{"marshal", "attempt", "unmarshal", "wait", "attempt", "unmarshal"}
+	if len(names) != len(expected) {
+		t.Fatalf("Operation has subsegments %v instead of %v", names, expected)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("Operation has subsegments %v instead of %v", names, expected)
+		}
+	}
+	for i, span := range children {
+		if failed := span.Tag("error") == true; failed != (i == 2) {
+			t.Errorf("Unexpected error tag on %v %v: %v", span.OperationName, i, span.Tags())
+		}
+	}
+}
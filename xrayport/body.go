@@ -0,0 +1,82 @@
+package xrayport
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// Body wraps a response body so that reading it is traced by a read_body span, a child of
+// the span in ctx, from the first byte to EOF or Close. The span is tagged with the bytes
+// read and the throughput. The body is returned as is when ctx has no span or carries a
+// decision not to trace.
+func Body(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil || body == nil || notSampled(ctx) {
+		return body
+	}
+	return &bodyReader{ReadCloser: body, parent: parent}
+}
+
+type bodyReader struct {
+	io.ReadCloser
+	parent opentracing.Span
+
+	mu    sync.Mutex
+	span  opentracing.Span
+	start time.Time
+	bytes int64
+	done  bool
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	n, err := br.ReadCloser.Read(p)
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if n > 0 && br.span == nil && !br.done {
+		br.start = time.Now()
+		br.span = br.parent.Tracer().StartSpan("read_body", opentracing.ChildOf(br.parent.Context()), opentracing.StartTime(br.start))
+	}
+	br.bytes += int64(n)
+	if err != nil {
+		br.finish(err)
+	}
+	return n, err
+}
+
+func (br *bodyReader) Close() error {
+	err := br.ReadCloser.Close()
+
+	br.mu.Lock()
+	br.finish(nil)
+	br.mu.Unlock()
+	return err
+}
+
+// finish closes the span once, marking it as an error for anything but EOF
+func (br *bodyReader) finish(err error) {
+	if br.done {
+		return
+	}
+	br.done = true
+	if br.span == nil {
+		return
+	}
+
+	elapsed := time.Since(br.start)
+	br.span.SetTag("bytes", br.bytes)
+	br.span.SetTag("complete", err == io.EOF)
+	if secs := elapsed.Seconds(); secs > 0 {
+		br.span.SetTag("throughput_bps", float64(br.bytes)/secs)
+	}
+	if err != nil && err != io.EOF {
+		br.span.SetTag("error", true)
+		br.span.LogFields(log.String("errors", err.Error()))
+	}
+	br.span.Finish()
+}
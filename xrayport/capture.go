@@ -10,18 +10,69 @@ package xrayport
 
 import (
 	"context"
+	"fmt"
+	"runtime/debug"
 
 	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
 )
 
+// CaptureOption configures Capture and CaptureAsync
+type CaptureOption func(*captureConfig)
+
+type captureConfig struct {
+	recoverPanics   bool
+	sampler         *Sampler
+	samplingRequest SamplingRequest
+}
+
+// RecoverPanics makes Capture return a panic in the captured function as a *PanicError
+// instead of panicking again once the span is finished
+func RecoverPanics() CaptureOption {
+	return func(c *captureConfig) {
+		c.recoverPanics = true
+	}
+}
+
+// PanicError is a panic recovered by Capture
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (pe *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", pe.Value)
+}
+
 // Capture traces the provided synchronous function by
 // beginning and closing a subsegment around its execution.
-func Capture(ctx context.Context, name string, fn func(context.Context) error) (err error) {
-	span, c := opentracing.StartSpanFromContext(ctx, name)
+// An error returned by fn is tagged on the span with its type and message, and a panic
+// is recorded with its stack trace before panicking again, or returned as a *PanicError
+// with RecoverPanics. When the sampling decision in ctx, or made with Sample, is not to
+// trace, fn is run without a span.
+func Capture(ctx context.Context, name string, fn func(context.Context) error, opts ...CaptureOption) (err error) {
+	var cc captureConfig
+	for _, opt := range opts {
+		opt(&cc)
+	}
+
+	var span opentracing.Span
+	var c context.Context
+	ctx, sampled := decide(ctx, cc.sampler, cc.samplingRequest)
+	if sampled {
+		span, c = opentracing.StartSpanFromContext(ctx, name)
+	}
 	// c, seg := BeginSubsegment(ctx, name)
 
 	defer func() {
 		if span != nil {
+			if err != nil {
+				if pe, ok := err.(*PanicError); ok {
+					recordPanic(span, pe)
+				} else {
+					recordError(span, err)
+				}
+			}
 			span.Finish()
 		} // XXX Not sure what to do with rest of this
 
@@ -38,7 +89,21 @@ func Capture(ctx context.Context, name string, fn func(context.Context) error) (
 		// }
 	}()
 
-	// XXX also not sure what to do with this
+	// The span is finished by the deferred function above, which runs after this one
+	defer func() {
+		if p := recover(); p != nil {
+			pe := &PanicError{Value: p, Stack: debug.Stack()}
+			if !cc.recoverPanics {
+				if span != nil {
+					recordPanic(span, pe)
+					span.Finish()
+					span = nil
+				}
+				panic(p)
+			}
+			err = pe
+		}
+	}()
 
 	// defer func() {
 	// 	if p := recover(); p != nil {
@@ -56,14 +121,31 @@ func Capture(ctx context.Context, name string, fn func(context.Context) error) (
 	return err
 }
 
+// recordError tags the span with the error's type and message
+func recordError(span opentracing.Span, err error) {
+	span.SetTag("error", true)
+	span.SetTag("error.kind", fmt.Sprintf("%T", err))
+	span.SetTag("error.message", err.Error())
+	span.LogFields(log.String("event", "error"), log.String("errors", err.Error()))
+}
+
+// recordPanic tags the span with the panic and logs its stack trace
+func recordPanic(span opentracing.Span, pe *PanicError) {
+	message := fmt.Sprint(pe.Value)
+	span.SetTag("error", true)
+	span.SetTag("error.kind", "panic")
+	span.SetTag("error.message", message)
+	span.LogFields(log.String("event", "panic"), log.String("errors", message), log.String("stack", string(pe.Stack)))
+}
+
 // CaptureAsync traces an arbitrary code segment within a goroutine.
 // Use CaptureAsync instead of manually calling Capture within a goroutine
 // to ensure the segment is flushed properly.
-func CaptureAsync(ctx context.Context, name string, fn func(context.Context) error) {
+func CaptureAsync(ctx context.Context, name string, fn func(context.Context) error, opts ...CaptureOption) {
 	started := make(chan struct{})
 	go Capture(ctx, name, func(ctx context.Context) error {
 		close(started)
 		return fn(ctx)
-	})
+	}, opts...)
 	<-started
 }
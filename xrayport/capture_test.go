@@ -0,0 +1,70 @@
+package xrayport_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+)
+
+func TestCapture(t *testing.T) {
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	tests := []struct {
+		fn      func(context.Context) error
+		opts    []xrayport.CaptureOption
+		kind    string
+		message string
+		panics  bool
+	}{
+		{func(context.Context) error { return nil }, nil, "", "", false},
+		{func(context.Context) error { return errors.New("Bad object") }, nil, "*errors.errorString", "Bad object", false},
+		{func(context.Context) error { panic("nil reader") }, []xrayport.CaptureOption{xrayport.RecoverPanics()}, "panic", "nil reader", false},
+		{func(context.Context) error { panic("nil reader") }, nil, "panic", "nil reader", true},
+	}
+
+	for _, test := range tests {
+		tracer.Reset()
+		var err error
+		panicked := func() (panicked bool) {
+			defer func() {
+				panicked = recover() != nil
+			}()
+			err = xrayport.Capture(context.Background(), "fetch", test.fn, test.opts...)
+			return false
+		}()
+
+		if panicked != test.panics {
+			t.Errorf("Panicked was %v for %v", panicked, test.message)
+		}
+		if test.kind == "panic" && !test.panics {
+			if pe, ok := err.(*xrayport.PanicError); !ok || pe.Value != "nil reader" || len(pe.Stack) == 0 {
+				t.Errorf("Unexpected error %v", err)
+			}
+		}
+
+		spans := tracer.FinishedSpans()
+		if len(spans) != 1 {
+			t.Fatalf("Got %v spans for %v", len(spans), test.message)
+		}
+		tags := spans[0].Tags()
+		if test.kind == "" {
+			if tags["error"] != nil {
+				t.Errorf("Unexpected error tag %v", tags)
+			}
+			continue
+		}
+		if tags["error"] != true || tags["error.kind"] != test.kind || tags["error.message"] != test.message {
+			t.Errorf("Unexpected tags %v for %v", tags, test.message)
+		}
+		if test.kind == "panic" {
+			logs := spans[0].Logs()
+			if len(logs) != 1 || logs[0].Fields[2].Key != "stack" || !strings.Contains(logs[0].Fields[2].ValueString, "TestCapture") {
+				t.Errorf("Missing stack trace in %v", logs)
+			}
+		}
+	}
+}
@@ -23,7 +23,7 @@ const emptyHostRename = "empty_host_error"
 // Client creates a shallow copy of the provided http client,
 // defaulting to http.DefaultClient, with roundtripper wrapped
 // with xray.RoundTripper.
-func Client(c *http.Client) *http.Client {
+func Client(c *http.Client, opts ...ClientOption) *http.Client {
 	if c == nil {
 		c = http.DefaultClient
 	}
@@ -32,7 +32,7 @@ func Client(c *http.Client) *http.Client {
 		transport = http.DefaultTransport
 	}
 	return &http.Client{
-		Transport:     RoundTripper(transport),
+		Transport:     RoundTripper(transport, opts...),
 		CheckRedirect: c.CheckRedirect,
 		Jar:           c.Jar,
 		Timeout:       c.Timeout,
@@ -41,12 +41,13 @@ func Client(c *http.Client) *http.Client {
 
 // RoundTripper wraps the provided http roundtripper with xray.Capture,
 // sets HTTP-specific xray fields, and adds the trace header to the outbound request.
-func RoundTripper(rt http.RoundTripper) http.RoundTripper {
-	return &roundtripper{rt}
+func RoundTripper(rt http.RoundTripper, opts ...ClientOption) http.RoundTripper {
+	return &roundtripper{rt, newClientConfig(opts)}
 }
 
 type roundtripper struct {
-	Base http.RoundTripper
+	Base   http.RoundTripper
+	config *clientConfig
 }
 
 // RoundTrip wraps a single HTTP transaction and add corresponding information into a subsegment.
@@ -63,7 +64,13 @@ func (rt *roundtripper) RoundTrip(r *http.Request) (*http.Response, error) {
 		}
 	}
 
-	err := Capture(r.Context(), host, func(ctx context.Context) error {
+	ctx, sampled := decide(r.Context(), rt.config.sampler, SamplingRequest{Host: host, Method: r.Method, URLPath: r.URL.Path})
+	if !sampled {
+		rt.config.injectNotSampled(opentracing.SpanFromContext(ctx), r.Header)
+		return rt.Base.RoundTrip(r.WithContext(ctx))
+	}
+
+	err := Capture(ctx, host, func(ctx context.Context) error {
 		var err error
 		span := opentracing.SpanFromContext(ctx)
 
@@ -80,7 +87,7 @@ func (rt *roundtripper) RoundTrip(r *http.Request) (*http.Response, error) {
 		// 	return err
 		// }
 
-		ct, e := NewClientTrace(ctx)
+		ct, e := newClientTrace(ctx, rt.config.granularity)
 		if e != nil {
 			return e
 		}
@@ -93,6 +100,9 @@ func (rt *roundtripper) RoundTrip(r *http.Request) (*http.Response, error) {
 		// } else {
 		// 	seg.Namespace = "remote"
 		// }
+		if host != emptyHostRename {
+			span.SetTag("namespace", "remote")
+		}
 
 		ext.SpanKindRPCClient.Set(span)
 		ext.HTTPMethod.Set(span, r.Method)
@@ -101,17 +111,20 @@ func (rt *roundtripper) RoundTrip(r *http.Request) (*http.Response, error) {
 		// seg.GetHTTP().GetRequest().Method = r.Method
 		// seg.GetHTTP().GetRequest().URL = r.URL.String()
 
-		_ = inject(opentracing.GlobalTracer(), span, r.Header)
+		_ = rt.config.inject(span, r.Header)
 
 		// r.Header.Set(TraceIDHeaderKey, seg.DownstreamHeader().String())
 		// seg.Unlock()
 
 		resp, err = rt.Base.RoundTrip(r)
+		recordGCSAttempt(ctx, resp)
 
 		if resp != nil {
 			ext.HTTPStatusCode.Set(span, uint16(resp.StatusCode)) // XXX Castin' like C
 			contentLength, _ := strconv.Atoi(resp.Header.Get("Content-Length"))
 			span.SetTag("ContentLength", contentLength)
+			span.SetTag("http.protocol", resp.Proto)
+			resp.Body = Body(ctx, resp.Body)
 			// seg.Lock()
 			// seg.GetHTTP().GetResponse().Status = resp.StatusCode
 			// seg.GetHTTP().GetResponse().ContentLength, _ = strconv.Atoi(resp.Header.Get("Content-Length"))
@@ -138,7 +151,3 @@ func (rt *roundtripper) RoundTrip(r *http.Request) (*http.Response, error) {
 	})
 	return resp, err
 }
-
-func inject(tracer opentracing.Tracer, span opentracing.Span, header http.Header) error {
-	return tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
-}
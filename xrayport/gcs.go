@@ -0,0 +1,97 @@
+package xrayport
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// GCSUploadIDHeaderKey is the response header Cloud Storage uses as its request ID
+const GCSUploadIDHeaderKey = "x-guploader-uploadid"
+
+// GCSGenerationHeaderKey is the response header carrying an object's generation
+const GCSGenerationHeaderKey = "x-goog-generation"
+
+type gcsOperationKey struct{}
+
+// gcsOperation collects what the HTTP requests of one Cloud Storage operation returned
+type gcsOperation struct {
+	mu         sync.Mutex
+	attempts   int
+	status     int
+	uploadID   string
+	generation string
+}
+
+// record notes one HTTP attempt made for the operation
+func (op *gcsOperation) record(resp *http.Response) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.attempts++
+	if resp == nil {
+		return
+	}
+	op.status = resp.StatusCode
+	if id := resp.Header.Get(GCSUploadIDHeaderKey); id != "" {
+		op.uploadID = id
+	}
+	if gen := resp.Header.Get(GCSGenerationHeaderKey); gen != "" {
+		op.generation = gen
+	}
+}
+
+// GCS traces a Cloud Storage operation, such as opening a reader, with a gcs span like
+// the operation spans AWS makes for S3. The HTTP requests fn makes with its context
+// through a Client are counted as the operation's attempts, and the span is tagged with
+// the operation, bucket, object, retries, generation and the upload ID request ID. Errors
+// and panics are recorded as by Capture, which is passed opts, so Sample can decide
+// whether the operation is traced.
+func GCS(ctx context.Context, operation, bucket, object string, fn func(context.Context) error, opts ...CaptureOption) error {
+	return Capture(ctx, "gcs", func(ctx context.Context) error {
+		span := opentracing.SpanFromContext(ctx)
+		if notSampled(ctx) || span == nil {
+			return fn(ctx)
+		}
+		op := &gcsOperation{}
+
+		err := fn(context.WithValue(ctx, gcsOperationKey{}, op))
+
+		op.mu.Lock()
+		defer op.mu.Unlock()
+
+		span.SetTag("namespace", "remote")
+		span.SetTag("operation", operation)
+		span.SetTag("bucket_name", bucket)
+		if object != "" {
+			span.SetTag("key", object)
+		}
+		if op.attempts > 0 {
+			span.SetTag("retries", op.attempts-1)
+		}
+		span.SetTag("RequestID", op.uploadID)
+		if op.generation != "" {
+			if gen, perr := strconv.ParseInt(op.generation, 10, 64); perr == nil {
+				span.SetTag("generation", gen)
+			}
+		}
+		if op.status != 0 {
+			ext.HTTPStatusCode.Set(span, uint16(op.status)) // XXX Castin' like C
+		}
+		if op.status == 429 {
+			span.SetTag("Throttle", true)
+		}
+
+		return err
+	}, opts...)
+}
+
+func recordGCSAttempt(ctx context.Context, resp *http.Response) {
+	if op, ok := ctx.Value(gcsOperationKey{}).(*gcsOperation); ok {
+		op.record(resp)
+	}
+}
@@ -0,0 +1,74 @@
+package xrayport_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+// rewriteTransport sends every request to a test server
+type rewriteTransport struct {
+	host string
+}
+
+func (rt rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.URL.Scheme, r.URL.Host = "http", rt.host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestGCSOperation(t *testing.T) {
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-GUploader-UploadID", "upload-1")
+		w.Header().Set("X-Goog-Generation", "1556835845")
+		w.Header().Set("X-Goog-Metageneration", "1")
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	hc := xrayport.Client(&http.Client{Transport: rewriteTransport{srv.Listener.Addr().String()}})
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(hc))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	root := tracer.StartSpan("requestObject")
+	ctx := opentracing.ContextWithSpan(context.Background(), root)
+	err = xrayport.GCS(ctx, "NewReader", "objcheck-us-east1", "10_1_1k.obj", func(ctx context.Context) error {
+		rdr, err := client.Bucket("objcheck-us-east1").Object("10_1_1k.obj").NewReader(ctx)
+		if err == nil {
+			rdr.Close()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	var op *mocktracer.MockSpan
+	for _, span := range tracer.FinishedSpans() {
+		if span.OperationName == "gcs" {
+			op = span
+		}
+	}
+	if op == nil {
+		t.Fatal("Missing gcs span")
+	}
+	if op.ParentID != root.(*mocktracer.MockSpan).SpanContext.SpanID {
+		t.Error("gcs span isn't a child of the caller's span")
+	}
+	tags := op.Tags()
+	if tags["RequestID"] != "upload-1" || tags["generation"] != int64(1556835845) || tags["retries"] != 0 || tags["key"] != "10_1_1k.obj" {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+}
@@ -0,0 +1,165 @@
+package xrayport
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// Granularity selects how the HTTP phases of a request, connect, dns, dial, tls, request
+// and response, are recorded
+type Granularity int
+
+const (
+	// GranularitySpans records each phase as a child span of the request span
+	GranularitySpans Granularity = iota
+	// GranularityEvents records each phase as timestamped start and done events on the
+	// request span, with the phase details in the done event and a duration tag
+	GranularityEvents
+	// GranularityTimings records only a duration tag for each phase on the request span
+	GranularityTimings
+)
+
+var granularities = map[string]Granularity{
+	"spans":   GranularitySpans,
+	"events":  GranularityEvents,
+	"timings": GranularityTimings,
+}
+
+// ParseGranularity returns the granularity named spans, events or timings
+func ParseGranularity(name string) (Granularity, bool) {
+	g, ok := granularities[strings.ToLower(name)]
+	return g, ok
+}
+
+// WithGranularity sets how the HTTP phases of the client's requests are recorded, the
+// default is GranularitySpans
+func WithGranularity(g Granularity) ClientOption {
+	return func(c *clientConfig) {
+		c.granularity = g
+	}
+}
+
+// startPhase begins the named phase beneath the span in ctx. At GranularitySpans this is
+// a child span, otherwise a phaseSpan recording onto the request span of the HTTPSpans.
+func (xt *HTTPSpans) startPhase(ctx context.Context, name string) (opentracing.Span, context.Context) {
+	if xt.granularity == GranularitySpans {
+		return opentracing.StartSpanFromContext(ctx, name)
+	}
+	op := opentracing.SpanFromContext(xt.opCtx)
+	if op == nil {
+		return opentracing.StartSpanFromContext(ctx, name)
+	}
+	span := &phaseSpan{op: op, name: name, start: time.Now(), granularity: xt.granularity}
+	if xt.granularity == GranularityEvents {
+		op.LogFields(log.String("event", name+"_start"))
+	}
+	return span, opentracing.ContextWithSpan(xt.opCtx, span)
+}
+
+// phaseSpan stands in for the span of an HTTP phase when phases aren't recorded as spans.
+// Tags and logs are kept for the done event, and finishing it tags the request span with
+// the phase's duration in milliseconds, such as dns_ms.
+type phaseSpan struct {
+	op          opentracing.Span
+	name        string
+	start       time.Time
+	granularity Granularity
+
+	mu       sync.Mutex
+	fields   []log.Field
+	finished bool
+}
+
+func (ps *phaseSpan) Finish() {
+	ps.FinishWithOptions(opentracing.FinishOptions{})
+}
+
+func (ps *phaseSpan) FinishWithOptions(opts opentracing.FinishOptions) {
+	if opts.FinishTime.IsZero() {
+		opts.FinishTime = time.Now()
+	}
+
+	ps.mu.Lock()
+	if ps.finished {
+		ps.mu.Unlock()
+		return
+	}
+	ps.finished = true
+	fields := ps.fields
+	ps.mu.Unlock()
+
+	ms := float64(opts.FinishTime.Sub(ps.start)) / float64(time.Millisecond)
+	ps.op.SetTag(ps.name+"_ms", ms)
+	if ps.granularity == GranularityEvents {
+		fields = append([]log.Field{log.String("event", ps.name+"_done"), log.Float64("duration_ms", ms)}, fields...)
+		ps.op.LogFields(fields...)
+	}
+}
+
+func (ps *phaseSpan) Context() opentracing.SpanContext {
+	return ps.op.Context()
+}
+
+func (ps *phaseSpan) SetOperationName(operationName string) opentracing.Span {
+	return ps
+}
+
+// SetTag keeps the tag for the done event, errors are also tagged on the request span as
+// the phase name with _error
+func (ps *phaseSpan) SetTag(key string, value interface{}) opentracing.Span {
+	if ps.granularity == GranularityEvents {
+		ps.mu.Lock()
+		ps.fields = append(ps.fields, log.Object(key, value))
+		ps.mu.Unlock()
+	}
+	if key == "error" && value == true {
+		ps.op.SetTag(ps.name+"_error", true)
+	}
+	return ps
+}
+
+func (ps *phaseSpan) LogFields(fields ...log.Field) {
+	if ps.granularity == GranularityEvents {
+		ps.mu.Lock()
+		ps.fields = append(ps.fields, fields...)
+		ps.mu.Unlock()
+	}
+}
+
+func (ps *phaseSpan) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := log.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		return
+	}
+	ps.LogFields(fields...)
+}
+
+func (ps *phaseSpan) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	ps.op.SetBaggageItem(restrictedKey, value)
+	return ps
+}
+
+func (ps *phaseSpan) BaggageItem(restrictedKey string) string {
+	return ps.op.BaggageItem(restrictedKey)
+}
+
+func (ps *phaseSpan) Tracer() opentracing.Tracer {
+	return ps.op.Tracer()
+}
+
+func (ps *phaseSpan) LogEvent(event string) {
+	ps.LogFields(log.String("event", event))
+}
+
+func (ps *phaseSpan) LogEventWithPayload(event string, payload interface{}) {
+	ps.LogFields(log.String("event", event), log.Object("payload", payload))
+}
+
+func (ps *phaseSpan) Log(ld opentracing.LogData) {
+	ps.LogFields(ld.ToLogRecord().Fields...)
+}
@@ -0,0 +1,94 @@
+package xrayport_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestGranularity(t *testing.T) {
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		granularity string
+		spans       int
+		events      bool
+	}{
+		{"spans", 5, false},
+		{"events", 1, true},
+		{"timings", 1, false},
+	}
+
+	for _, test := range tests {
+		tracer.Reset()
+		g, ok := xrayport.ParseGranularity(test.granularity)
+		if !ok {
+			t.Fatalf("Missing granularity %v", test.granularity)
+		}
+		// A new transport so each request dials
+		hc := xrayport.Client(&http.Client{Transport: &http.Transport{}}, xrayport.WithGranularity(g))
+
+		root := tracer.StartSpan("requestObject")
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		resp, err := hc.Do(req.WithContext(opentracing.ContextWithSpan(context.Background(), root)))
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		root.Finish()
+
+		// Everything but the root and read_body spans, the connect span can finish twice
+		spans := make(map[int]bool)
+		var request *mocktracer.MockSpan
+		for _, span := range tracer.FinishedSpans() {
+			switch span.OperationName {
+			case "requestObject", "read_body":
+			default:
+				spans[span.SpanContext.SpanID] = true
+			}
+			if span.ParentID == root.(*mocktracer.MockSpan).SpanContext.SpanID {
+				request = span
+			}
+		}
+		if len(spans) != test.spans {
+			t.Errorf("Got %v spans instead of %v for %v", len(spans), test.spans, test.granularity)
+		}
+		if request == nil {
+			t.Fatalf("Missing request span for %v", test.granularity)
+		}
+
+		tags := request.Tags()
+		for _, phase := range []string{"connect", "dial", "request", "response"} {
+			_, ok := tags[phase+"_ms"]
+			if ok == (test.granularity == "spans") {
+				t.Errorf("Unexpected %v_ms tag for %v", phase, test.granularity)
+			}
+		}
+
+		events := 0
+		for _, lr := range request.Logs() {
+			for _, f := range lr.Fields {
+				if f.Key == "event" && strings.HasPrefix(f.ValueString, "dial_") {
+					events++
+				}
+			}
+		}
+		if (events == 2) != test.events {
+			t.Errorf("Got %v dial events for %v", events, test.granularity)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package xrayport
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Group runs tasks in goroutines and waits for them, like errgroup.Group. Each task is
+// captured under a child span of the group's context, the number running at once can be
+// limited, and the first error can cancel the rest.
+type Group struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	sem      chan struct{}
+	failFast bool
+	opts     []CaptureOption
+
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	next int
+	errs GroupError
+}
+
+// GroupOption configures NewGroup
+type GroupOption func(*Group)
+
+// WithLimit runs at most n tasks at once, Go blocks until one finishes. n < 1 is no limit.
+func WithLimit(n int) GroupOption {
+	return func(g *Group) {
+		if n > 0 {
+			g.sem = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithFailFast cancels the group's context when a task returns an error
+func WithFailFast() GroupOption {
+	return func(g *Group) {
+		g.failFast = true
+	}
+}
+
+// WithCaptureOptions passes opts to the Capture of each task, such as RecoverPanics
+func WithCaptureOptions(opts ...CaptureOption) GroupOption {
+	return func(g *Group) {
+		g.opts = append(g.opts, opts...)
+	}
+}
+
+// NewGroup returns a Group and the context its tasks run with, which is derived from ctx
+// and canceled when Wait returns, or on the first error WithFailFast
+func NewGroup(ctx context.Context, opts ...GroupOption) (*Group, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	g := &Group{ctx: ctx, cancel: cancel}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g, ctx
+}
+
+// Go runs fn in a goroutine under a span named name, waiting first for a free slot when
+// the group is limited. A task whose group is canceled before it gets a slot isn't run,
+// and fails with the context's error.
+func (g *Group) Go(name string, fn func(context.Context) error) {
+	g.mu.Lock()
+	index := g.next
+	g.next++
+	g.mu.Unlock()
+
+	if g.sem != nil {
+		acquired := false
+		select {
+		case g.sem <- struct{}{}:
+			acquired = true
+		case <-g.ctx.Done():
+		}
+		// A slot may have been free as the group was canceled
+		if err := g.ctx.Err(); err != nil {
+			if acquired {
+				<-g.sem
+			}
+			g.fail(index, name, err)
+			return
+		}
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if g.sem != nil {
+			defer func() { <-g.sem }()
+		}
+
+		if err := Capture(g.ctx, name, fn, g.opts...); err != nil {
+			g.fail(index, name, err)
+			if g.failFast {
+				g.cancel()
+			}
+		}
+	}()
+}
+
+// fail records the error of a task
+func (g *Group) fail(index int, name string, err error) {
+	g.mu.Lock()
+	g.errs = append(g.errs, &TaskError{Index: index, Name: name, Err: err})
+	g.mu.Unlock()
+}
+
+// Wait waits for every task to finish and returns a GroupError of their errors in the
+// order the tasks were started, or nil when all succeeded
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.errs) == 0 {
+		return nil
+	}
+	errs := make(GroupError, len(g.errs))
+	copy(errs, g.errs)
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Index < errs[j].Index })
+	return errs
+}
+
+// TaskError is the error of one Group task, Index counts the calls to Go from 0
+type TaskError struct {
+	Index int
+	Name  string
+	Err   error
+}
+
+func (te *TaskError) Error() string {
+	return fmt.Sprintf("%v %v: %v", te.Name, te.Index, te.Err.Error())
+}
+
+// Unwrap returns the task's error
+func (te *TaskError) Unwrap() error {
+	return te.Err
+}
+
+// GroupError holds the errors of the failed tasks in a Group
+type GroupError []*TaskError
+
+func (ge GroupError) Error() string {
+	msgs := make([]string, len(ge))
+	for i, te := range ge {
+		msgs[i] = te.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
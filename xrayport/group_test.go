@@ -0,0 +1,101 @@
+package xrayport_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestGroup(t *testing.T) {
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	root := tracer.StartSpan("ObjCheck")
+	g, _ := xrayport.NewGroup(opentracing.ContextWithSpan(context.Background(), root), xrayport.WithLimit(2))
+	var mu sync.Mutex
+	running, most := 0, 0
+	for i := 0; i < 6; i++ {
+		i := i
+		g.Go("task", func(ctx context.Context) error {
+			mu.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if i%2 == 1 {
+				return fmt.Errorf("Bad task %v", i)
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+
+	if most != 2 {
+		t.Errorf("Ran %v tasks at once instead of 2", most)
+	}
+	ge, ok := err.(xrayport.GroupError)
+	if !ok || len(ge) != 3 || ge[0].Index != 1 || ge[1].Index != 3 || ge[2].Index != 5 {
+		t.Errorf("Unexpected error %v", err)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 6 {
+		t.Fatalf("Got %v spans instead of 6", len(spans))
+	}
+	for _, span := range spans {
+		if span.ParentID != root.(*mocktracer.MockSpan).SpanContext.SpanID {
+			t.Errorf("Task span %v isn't a child of the group's span", span.OperationName)
+		}
+	}
+
+	// The first error cancels the rest
+	g, ctx := xrayport.NewGroup(context.Background(), xrayport.WithFailFast(), xrayport.WithCaptureOptions(xrayport.RecoverPanics()))
+	g.Go("panics", func(ctx context.Context) error {
+		panic("nil reader")
+	})
+	g.Go("waits", func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	})
+	err = g.Wait()
+	ge, ok = err.(xrayport.GroupError)
+	if !ok || len(ge) != 2 || ge[1].Err != context.Canceled {
+		t.Errorf("Unexpected error %v", err)
+	} else if _, ok := ge[0].Err.(*xrayport.PanicError); !ok {
+		t.Errorf("Unexpected error %v", ge[0].Err)
+	}
+	if ctx.Err() == nil {
+		t.Error("Group context wasn't canceled")
+	}
+
+	// Tasks waiting for a slot when the group is canceled aren't run
+	g, _ = xrayport.NewGroup(context.Background(), xrayport.WithLimit(1), xrayport.WithFailFast())
+	g.Go("fails", func(ctx context.Context) error {
+		time.Sleep(5 * time.Millisecond)
+		return fmt.Errorf("Bad task")
+	})
+	ran := false
+	g.Go("waits", func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	err = g.Wait()
+	ge, ok = err.(xrayport.GroupError)
+	if ran || !ok || len(ge) != 2 || ge[0].Err.Error() != "Bad task" || ge[1].Err != context.Canceled {
+		t.Errorf("Unexpected error %v after running the waiting task %v", err, ran)
+	}
+}
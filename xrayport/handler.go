@@ -0,0 +1,187 @@
+package xrayport
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	// TraceparentHeaderKey is the W3C Trace Context header
+	TraceparentHeaderKey = "traceparent"
+
+	otTraceIDHeaderKey = "ot-tracer-traceid"
+	otSpanIDHeaderKey  = "ot-tracer-spanid"
+	otSampledHeaderKey = "ot-tracer-sampled"
+)
+
+// remoteContext is a trace context received in a header the tracer doesn't read itself
+type remoteContext struct {
+	Format  string
+	TraceID string
+	SpanID  string
+	Sampled bool
+	Baggage map[string]string
+}
+
+// parseTraceparent reads a W3C traceparent header, version-traceid-parentid-flags
+func parseTraceparent(header string) (remoteContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return remoteContext{}, false
+	}
+	if !isHex(parts[1]) || !isHex(parts[2]) || strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return remoteContext{}, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return remoteContext{}, false
+	}
+	return remoteContext{Format: "w3c", TraceID: parts[1], SpanID: parts[2], Sampled: flags&1 == 1}, true
+}
+
+// parseAmznTraceID reads an X-Amzn-Trace-Id header, Root=1-time-id;Parent=id;Sampled=1
+func parseAmznTraceID(header string) (remoteContext, bool) {
+	rc := remoteContext{Format: "xray", Sampled: true}
+	for _, field := range strings.Split(header, ";") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Root":
+			parts := strings.Split(kv[1], "-")
+			if len(parts) != 3 || parts[0] != "1" || len(parts[1]) != 8 || len(parts[2]) != 24 || !isHex(parts[1]+parts[2]) {
+				return remoteContext{}, false
+			}
+			rc.TraceID = parts[1] + parts[2]
+		case "Parent":
+			if len(kv[1]) != 16 || !isHex(kv[1]) {
+				return remoteContext{}, false
+			}
+			rc.SpanID = kv[1]
+		case "Sampled":
+			rc.Sampled = kv[1] != "0"
+		case "Self", "Lineage":
+			// Added by load balancers and Lambda, not part of the caller's context
+		default:
+			if rc.Baggage == nil {
+				rc.Baggage = make(map[string]string)
+			}
+			rc.Baggage[kv[0]] = kv[1]
+		}
+	}
+	if rc.TraceID == "" || rc.SpanID == "" {
+		return remoteContext{}, false
+	}
+	return rc, true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// headers returns the context as the ot-tracer headers used by LightStep and other
+// basictracer based tracers, which only keep the low 64 bits of the trace ID, and as
+// the X-Ray header read by Tracer
+func (rc remoteContext) headers() http.Header {
+	h := http.Header{}
+	h.Set(otTraceIDHeaderKey, rc.TraceID[len(rc.TraceID)-16:])
+	h.Set(otSpanIDHeaderKey, rc.SpanID)
+	h.Set(otSampledHeaderKey, strconv.FormatBool(rc.Sampled))
+	h.Set(TraceIDHeaderKey, rc.amznTraceID())
+	return h
+}
+
+// amznTraceID formats the context as an X-Amzn-Trace-Id header
+func (rc remoteContext) amznTraceID() string {
+	traceID := fmt.Sprintf("%032s", rc.TraceID)
+	sampled := "0"
+	if rc.Sampled {
+		sampled = "1"
+	}
+	return fmt.Sprintf("Root=1-%s-%s;Parent=%016s;Sampled=%s", traceID[:8], traceID[8:], rc.SpanID, sampled)
+}
+
+// extractContext finds the trace context of an incoming request, first in the tracer's
+// own headers, then W3C traceparent, then X-Amzn-Trace-Id. A remote context is returned
+// as well when it was found but the tracer couldn't use it as a parent.
+func extractContext(tracer opentracing.Tracer, header http.Header) (opentracing.SpanContext, string, *remoteContext) {
+	if sc, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header)); err == nil {
+		return sc, "opentracing", nil
+	}
+
+	var rc remoteContext
+	var ok bool
+	if v := header.Get(TraceparentHeaderKey); v != "" {
+		rc, ok = parseTraceparent(v)
+	}
+	if v := header.Get(TraceIDHeaderKey); !ok && v != "" {
+		rc, ok = parseAmznTraceID(v)
+	}
+	if !ok {
+		return nil, "", nil
+	}
+
+	if sc, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(rc.headers())); err == nil {
+		return sc, rc.Format, nil
+	}
+	return nil, rc.Format, &rc
+}
+
+// Handler wraps h so each request is traced by a server span named name. The span is a
+// child of the trace context found in the request's OpenTracing, W3C traceparent or
+// X-Amzn-Trace-Id headers, and is put on the request context for h to use.
+func Handler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracer := opentracing.GlobalTracer()
+		parent, format, remote := extractContext(tracer, r.Header)
+
+		span := tracer.StartSpan(name, ext.RPCServerOption(parent))
+		defer span.Finish()
+
+		ext.HTTPMethod.Set(span, r.Method)
+		ext.HTTPUrl.Set(span, r.URL.String())
+		span.SetTag("http.host", r.Host)
+		span.SetTag("peer.address", r.RemoteAddr)
+		if format != "" {
+			span.SetTag("trace.propagation", format)
+		}
+		if format == "w3c" && r.Header.Get(TracestateHeaderKey) != "" {
+			span.SetBaggageItem(TracestateHeaderKey, r.Header.Get(TracestateHeaderKey))
+		}
+		if remote != nil {
+			// The tracer can't continue this trace, so record where it came from
+			span.SetTag("parent.trace_id", remote.TraceID)
+			span.SetTag("parent.span_id", remote.SpanID)
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r.WithContext(opentracing.ContextWithSpan(r.Context(), span)))
+
+		ext.HTTPStatusCode.Set(span, uint16(sw.status)) // XXX Castin' like C
+		if sw.status >= 500 {
+			span.SetTag("error", true)
+		}
+	})
+}
+
+// statusWriter records the status code a handler writes
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
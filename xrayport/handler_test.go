@@ -0,0 +1,79 @@
+package xrayport_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestHandler(t *testing.T) {
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	caller := tracer.StartSpan("scheduler")
+	callerCtx := caller.Context().(mocktracer.MockSpanContext)
+	otHeaders := http.Header{}
+	if err := tracer.Inject(caller.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(otHeaders)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	var inner opentracing.Span
+	h := xrayport.Handler("ObjCheck", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner = opentracing.SpanFromContext(r.Context())
+		if r.Header.Get("Fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	tests := []struct {
+		headers    http.Header
+		format     string
+		parentID   int
+		traceID    string
+		tracestate string
+		status     uint16
+	}{
+		{http.Header{}, "", 0, "", "", 200},
+		{otHeaders, "opentracing", callerCtx.SpanID, "", "", 200},
+		{http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, "Tracestate": {"vendor=1"}}, "w3c", 0, "4bf92f3577b34da6a3ce929d0e0e4736", "vendor=1", 200},
+		{http.Header{"X-Amzn-Trace-Id": {"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"}}, "xray", 0, "5759e988bd862e3fe1be46a994272793", "", 200},
+		{http.Header{"Traceparent": {"00-00000000000000000000000000000000-00f067aa0ba902b7-01"}, "Fail": {"1"}}, "", 0, "", "", 500},
+	}
+
+	for _, test := range tests {
+		tracer.Reset()
+		inner = nil
+		r := httptest.NewRequest("GET", "/check", nil)
+		r.Header = test.headers
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		spans := tracer.FinishedSpans()
+		if len(spans) != 1 || spans[0].OperationName != "ObjCheck" {
+			t.Fatalf("Unexpected spans %v for %v", spans, test.headers)
+		}
+		span := spans[0]
+		if inner != opentracing.Span(span) {
+			t.Errorf("Handler didn't get the server span for %v", test.headers)
+		}
+		if span.ParentID != test.parentID {
+			t.Errorf("Parent was %v instead of %v for %v", span.ParentID, test.parentID, test.headers)
+		}
+		tags := span.Tags()
+		if tags["span.kind"] == nil || tags["http.method"] != "GET" || tags["http.status_code"] != test.status || (tags["error"] == true) != (test.status >= 500) {
+			t.Errorf("Unexpected tags %v for %v", tags, test.headers)
+		}
+		if format, _ := tags["trace.propagation"].(string); format != test.format {
+			t.Errorf("Propagation was %v instead of %v", format, test.format)
+		}
+		if traceID, _ := tags["parent.trace_id"].(string); traceID != test.traceID {
+			t.Errorf("Parent trace was %v instead of %v", traceID, test.traceID)
+		}
+		if ts := span.BaggageItem(xrayport.TracestateHeaderKey); ts != test.tracestate {
+			t.Errorf("Tracestate was %q instead of %q", ts, test.tracestate)
+		}
+	}
+}
@@ -14,8 +14,12 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"net"
 	"net/http/httptrace"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
@@ -30,6 +34,7 @@ type HTTPSpans struct {
 	tlsCtx      context.Context
 	reqCtx      context.Context
 	responseCtx context.Context
+	granularity Granularity
 	mu          sync.Mutex
 }
 
@@ -42,7 +47,7 @@ func NewHTTPSpans(opCtx context.Context) *HTTPSpans {
 // GetConn begins a connect subsegment if the HTTP operation
 // subsegment is still in progress.
 func (xt *HTTPSpans) GetConn(hostPort string) {
-	_, xt.connCtx = opentracing.StartSpanFromContext(xt.opCtx, "connect")
+	_, xt.connCtx = xt.startPhase(xt.opCtx, "connect")
 	// if GetSegment(xt.opCtx).safeInProgress() {
 	// 	xt.connCtx, _ = BeginSubsegment(xt.opCtx, "connect")
 	// }
@@ -53,7 +58,9 @@ func (xt *HTTPSpans) GetConn(hostPort string) {
 func (xt *HTTPSpans) DNSStart(info httptrace.DNSStartInfo) {
 	xt.mu.Lock()
 	defer xt.mu.Unlock()
-	_, xt.dnsCtx = opentracing.StartSpanFromContext(xt.connCtx, "dns")
+	span, dnsCtx := xt.startPhase(xt.connCtx, "dns")
+	span.SetTag("host", info.Host)
+	xt.dnsCtx = dnsCtx
 
 	// if GetSegment(xt.opCtx).safeInProgress() && xt.connCtx != nil {
 	// 	xt.dnsCtx, _ = BeginSubsegment(xt.connCtx, "dns")
@@ -68,7 +75,12 @@ func (xt *HTTPSpans) DNSStart(info httptrace.DNSStartInfo) {
 func (xt *HTTPSpans) DNSDone(info httptrace.DNSDoneInfo) {
 	if xt.dnsCtx != nil {
 		span := opentracing.SpanFromContext(xt.dnsCtx)
-		// span.SetTag("addresses", info.Addrs)
+		addrs := make([]string, len(info.Addrs))
+		for i, addr := range info.Addrs {
+			addrs[i] = addr.String()
+		}
+		span.SetTag("addresses", strings.Join(addrs, ","))
+		span.SetTag("address_count", len(addrs))
 		span.SetTag("coalesced", info.Coalesced)
 		if info.Err != nil {
 			span.SetTag("error", true)
@@ -94,7 +106,7 @@ func (xt *HTTPSpans) ConnectStart(network, addr string) {
 	defer xt.mu.Unlock()
 
 	if xt.connCtx != nil {
-		_, xt.connectCtx = opentracing.StartSpanFromContext(xt.connCtx, "dial")
+		_, xt.connectCtx = xt.startPhase(xt.connCtx, "dial")
 	}
 
 	// if GetSegment(xt.opCtx).safeInProgress() && xt.connCtx != nil {
@@ -110,6 +122,10 @@ func (xt *HTTPSpans) ConnectDone(network, addr string, err error) {
 	if xt.connectCtx != nil {
 		span := opentracing.SpanFromContext(xt.connectCtx)
 		span.SetTag("network", network)
+		span.SetTag("remote_addr", addr)
+		if family := IPFamily(addr); family != "" {
+			span.SetTag("ip_family", family)
+		}
 
 		if err != nil {
 			span.SetTag("error", true)
@@ -132,7 +148,7 @@ func (xt *HTTPSpans) ConnectDone(network, addr string, err error) {
 // subsegment is still in progress.
 func (xt *HTTPSpans) TLSHandshakeStart() {
 	if xt.connCtx != nil {
-		_, xt.tlsCtx = opentracing.StartSpanFromContext(xt.connCtx, "tls")
+		_, xt.tlsCtx = xt.startPhase(xt.connCtx, "tls")
 	}
 
 	// if GetSegment(xt.opCtx).safeInProgress() && xt.connCtx != nil {
@@ -152,6 +168,28 @@ func (xt *HTTPSpans) TLSHandshakeDone(connState tls.ConnectionState, err error)
 		span.SetTag("negotiated_protocol", connState.NegotiatedProtocol)
 		span.SetTag("negotiated_protocol_is_mutual", connState.NegotiatedProtocolIsMutual)
 		span.SetTag("cipher_suite", connState.CipherSuite)
+		span.SetTag("cipher_suite_name", tls.CipherSuiteName(connState.CipherSuite))
+		span.SetTag("tls_version", TLSVersionName(connState.Version))
+		span.SetTag("server_name", connState.ServerName)
+		span.SetTag("ocsp_stapled", len(connState.OCSPResponse) > 0)
+
+		if certs := connState.PeerCertificates; len(certs) > 0 {
+			leaf := certs[0]
+			span.SetTag("cert_subject", leaf.Subject.CommonName)
+			span.SetTag("cert_issuer", leaf.Issuer.CommonName)
+			span.SetTag("cert_not_after", leaf.NotAfter.UTC().Format(time.RFC3339))
+			span.SetTag("cert_key_type", leaf.PublicKeyAlgorithm.String())
+			span.SetTag("cert_chain_length", len(certs))
+			for i, cert := range certs {
+				span.LogFields(
+					log.Int("cert_index", i),
+					log.String("cert_subject", cert.Subject.CommonName),
+					log.String("cert_issuer", cert.Issuer.CommonName),
+					log.String("cert_not_after", cert.NotAfter.UTC().Format(time.RFC3339)),
+					log.String("cert_key_type", cert.PublicKeyAlgorithm.String()),
+				)
+			}
+		}
 
 		if err != nil {
 			span.SetTag("error", true)
@@ -183,6 +221,11 @@ func (xt *HTTPSpans) GotConn(info *httptrace.GotConnInfo, err error) {
 		span := opentracing.SpanFromContext(xt.connCtx)
 
 		if info != nil { // XXX Why only checked here?
+			if info.Conn != nil {
+				span.SetTag("conn_id", ConnID(info.Conn))
+				span.SetTag("local_addr", info.Conn.LocalAddr().String())
+				span.SetTag("remote_addr", info.Conn.RemoteAddr().String())
+			}
 			span.SetTag("reused", info.Reused)
 			span.SetTag("was_idle", info.WasIdle)
 			if info.WasIdle {
@@ -194,7 +237,7 @@ func (xt *HTTPSpans) GotConn(info *httptrace.GotConnInfo, err error) {
 			span.SetTag("error", true)
 			span.LogFields(log.String("errors", err.Error()))
 		} else {
-			_, xt.reqCtx = opentracing.StartSpanFromContext(xt.opCtx, "request")
+			_, xt.reqCtx = xt.startPhase(xt.opCtx, "request")
 		}
 
 		span.Finish()
@@ -244,7 +287,7 @@ func (xt *HTTPSpans) WroteRequest(info httptrace.WroteRequestInfo) {
 
 		span.Finish()
 
-		_, resCtx := opentracing.StartSpanFromContext(xt.opCtx, "response")
+		_, resCtx := xt.startPhase(xt.opCtx, "response")
 		xt.mu.Lock() // XXX Why only here?
 		xt.responseCtx = resCtx
 		xt.mu.Unlock()
@@ -289,6 +332,69 @@ func (xt *HTTPSpans) GotFirstResponseByte() {
 	// }
 }
 
+// IPFamily returns "ipv4" or "ipv6" for a host:port address, or "" when the
+// host isn't an IP address
+func IPFamily(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// maxConnIDs bounds how many connections ConnID remembers
+const maxConnIDs = 4096
+
+var connIDs = struct {
+	sync.Mutex
+	ids  map[string]uint64
+	last uint64
+}{ids: make(map[string]uint64)}
+
+// ConnID returns an ID for a connection that is stable within the process while the
+// connection is open, keyed by its local and remote addresses. Once maxConnIDs
+// connections have been seen the IDs are forgotten, and an open connection gets a new one.
+func ConnID(conn net.Conn) uint64 {
+	key := conn.LocalAddr().String() + ">" + conn.RemoteAddr().String()
+
+	connIDs.Lock()
+	defer connIDs.Unlock()
+	if id, ok := connIDs.ids[key]; ok {
+		return id
+	}
+	if len(connIDs.ids) >= maxConnIDs {
+		connIDs.ids = make(map[string]uint64)
+	}
+	connIDs.last++
+	connIDs.ids[key] = connIDs.last
+	return connIDs.last
+}
+
+// TLSVersionName returns the name of a TLS protocol version, such as "TLS 1.3", or ""
+// before a version was negotiated
+func TLSVersionName(v uint16) string {
+	switch v {
+	case 0:
+		return ""
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
 // ClientTrace is a set of pointers of HTTPSubsegments and ClientTrace.
 type ClientTrace struct {
 	spans     *HTTPSpans
@@ -300,11 +406,17 @@ type ClientTrace struct {
 // generate subsegments for connection time, DNS lookup time, TLS
 // handshake time, and provides additional information about the HTTP round trip
 func NewClientTrace(opCtx context.Context) (ct *ClientTrace, err error) {
+	return newClientTrace(opCtx, GranularitySpans)
+}
+
+// newClientTrace returns a ClientTrace recording the HTTP phases at granularity g
+func newClientTrace(opCtx context.Context, g Granularity) (ct *ClientTrace, err error) {
 	if opCtx == nil {
 		return nil, errors.New("opCtx must be non-nil")
 	}
 
 	spans := NewHTTPSpans(opCtx)
+	spans.granularity = g
 
 	return &ClientTrace{
 		spans: spans,
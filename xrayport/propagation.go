@@ -0,0 +1,298 @@
+package xrayport
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	// TracestateHeaderKey is the W3C Trace Context vendor state header, it is carried
+	// between services in the span baggage item of the same name
+	TracestateHeaderKey = "tracestate"
+
+	b3TraceIDHeaderKey = "x-b3-traceid"
+	b3SpanIDHeaderKey  = "x-b3-spanid"
+	b3SampledHeaderKey = "x-b3-sampled"
+)
+
+// Propagator writes a span's trace context to the headers of an outgoing request
+type Propagator interface {
+	Inject(tracer opentracing.Tracer, sc opentracing.SpanContext, header http.Header) error
+}
+
+var (
+	// OpenTracing propagates the context in the tracer's own HTTPHeaders format
+	OpenTracing Propagator = otPropagator{}
+	// W3C propagates the context in W3C Trace Context traceparent and tracestate headers
+	W3C Propagator = w3cPropagator{}
+	// B3 propagates the context in Zipkin B3 multi-header format
+	B3 Propagator = b3Propagator{}
+	// XRay propagates the context in the AWS X-Amzn-Trace-Id header
+	XRay Propagator = xrayPropagator{}
+)
+
+var propagators = map[string]Propagator{
+	"opentracing": OpenTracing,
+	"w3c":         W3C,
+	"b3":          B3,
+	"xray":        XRay,
+}
+
+// LookupPropagator returns the propagator named opentracing, w3c, b3 or xray, or nil
+func LookupPropagator(name string) Propagator {
+	return propagators[strings.ToLower(name)]
+}
+
+// ClientOption configures the tracing added by Client, RoundTripper, AWS and AWSV2
+type ClientOption func(*clientConfig)
+
+type clientConfig struct {
+	propagators []Propagator
+	granularity Granularity
+	sampler     *Sampler
+}
+
+func newClientConfig(opts []ClientOption) *clientConfig {
+	c := &clientConfig{propagators: []Propagator{OpenTracing}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithPropagators sets the formats the trace context is sent in, replacing the default
+// of OpenTracing alone. Each propagator writes its own headers to every request.
+func WithPropagators(p ...Propagator) ClientOption {
+	return func(c *clientConfig) {
+		c.propagators = p
+	}
+}
+
+// inject writes the span's context to header in each of the client's formats, returning
+// the first error
+func (c *clientConfig) inject(span opentracing.Span, header http.Header) error {
+	var first error
+	for _, p := range c.propagators {
+		if err := p.Inject(span.Tracer(), span.Context(), header); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// injectNotSampled sends the decision not to trace a call to the services it reaches, so
+// they don't trace it either. There is no span for the call, so each format is written
+// with the IDs of parent, the span the call was made in, or new IDs when there is none.
+func (c *clientConfig) injectNotSampled(parent opentracing.Span, header http.Header) {
+	ids := remoteContext{TraceID: newTraceID(time.Now()), SpanID: newID(8)}
+	if parent != nil {
+		if pids, err := spanIDs(parent.Tracer(), parent.Context()); err == nil {
+			ids = pids
+		}
+	}
+	ids.Sampled = false
+	for _, p := range c.propagators {
+		if np, ok := p.(notSampledPropagator); ok {
+			np.injectNotSampled(parent, ids, header)
+		}
+	}
+}
+
+// notSampledPropagator is a Propagator that can write a decision not to trace
+type notSampledPropagator interface {
+	injectNotSampled(parent opentracing.Span, ids remoteContext, header http.Header)
+}
+
+type otPropagator struct{}
+
+func (otPropagator) Inject(tracer opentracing.Tracer, sc opentracing.SpanContext, header http.Header) error {
+	return tracer.Inject(sc, opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+}
+
+// injectNotSampled writes the parent's context in the tracer's format with the sampled
+// flag of the formats spanIDs knows cleared, a tracer's own format needs a parent
+func (p otPropagator) injectNotSampled(parent opentracing.Span, ids remoteContext, header http.Header) {
+	if parent == nil {
+		return
+	}
+	carrier := http.Header{}
+	if err := p.Inject(parent.Tracer(), parent.Context(), carrier); err != nil {
+		return
+	}
+	for k, v := range carrier {
+		switch strings.ToLower(k) {
+		case otSampledHeaderKey, "mockpfx-ids-sampled":
+			v = []string{"false"}
+		case b3SampledHeaderKey:
+			v = []string{"0"}
+		case "uber-trace-id":
+			// traceid:spanid:parentid:flags
+			if parts := strings.Split(carrier.Get(k), ":"); len(parts) == 4 {
+				flags, _ := strconv.ParseUint(parts[3], 16, 8)
+				parts[3] = strconv.FormatUint(flags&^1, 16)
+				v = []string{strings.Join(parts, ":")}
+			}
+		case TraceIDHeaderKey:
+			if rc, ok := parseAmznTraceID(carrier.Get(k)); ok {
+				rc.Sampled = false
+				v = []string{rc.amznTraceID()}
+			}
+		}
+		header[k] = v
+	}
+}
+
+type w3cPropagator struct{}
+
+func (p w3cPropagator) Inject(tracer opentracing.Tracer, sc opentracing.SpanContext, header http.Header) error {
+	ids, err := spanIDs(tracer, sc)
+	if err != nil {
+		return err
+	}
+	p.inject(ids, sc, header)
+	return nil
+}
+
+func (p w3cPropagator) injectNotSampled(parent opentracing.Span, ids remoteContext, header http.Header) {
+	var sc opentracing.SpanContext
+	if parent != nil {
+		sc = parent.Context()
+	}
+	p.inject(ids, sc, header)
+}
+
+// inject writes traceparent, and tracestate from the baggage of sc when there is one
+func (w3cPropagator) inject(ids remoteContext, sc opentracing.SpanContext, header http.Header) {
+	flags := "00"
+	if ids.Sampled {
+		flags = "01"
+	}
+	header.Set(TraceparentHeaderKey, fmt.Sprintf("00-%032s-%016s-%s", ids.TraceID, ids.SpanID, flags))
+
+	if sc == nil {
+		return
+	}
+	sc.ForeachBaggageItem(func(k, v string) bool {
+		if k == TracestateHeaderKey {
+			header.Set(TracestateHeaderKey, v)
+			return false
+		}
+		return true
+	})
+}
+
+type b3Propagator struct{}
+
+func (p b3Propagator) Inject(tracer opentracing.Tracer, sc opentracing.SpanContext, header http.Header) error {
+	ids, err := spanIDs(tracer, sc)
+	if err != nil {
+		return err
+	}
+	p.injectNotSampled(nil, ids, header)
+	return nil
+}
+
+// injectNotSampled writes the B3 headers for ids, which are sampled or not as they say
+func (b3Propagator) injectNotSampled(parent opentracing.Span, ids remoteContext, header http.Header) {
+	header.Set(b3TraceIDHeaderKey, ids.TraceID)
+	header.Set(b3SpanIDHeaderKey, ids.SpanID)
+	if ids.Sampled {
+		header.Set(b3SampledHeaderKey, "1")
+	} else {
+		header.Set(b3SampledHeaderKey, "0")
+	}
+}
+
+type xrayPropagator struct{}
+
+// Inject writes the X-Ray header. X-Ray trace IDs start with the trace's epoch seconds,
+// which a 64 bit trace ID doesn't carry, so they are left as zeros and the trace ID
+// fills the rest; the ID is then still unique and can be found in provider logs.
+func (p xrayPropagator) Inject(tracer opentracing.Tracer, sc opentracing.SpanContext, header http.Header) error {
+	ids, err := spanIDs(tracer, sc)
+	if err != nil {
+		return err
+	}
+	p.injectNotSampled(nil, ids, header)
+	return nil
+}
+
+// injectNotSampled writes the X-Ray header for ids, which are sampled or not as they say
+func (xrayPropagator) injectNotSampled(parent opentracing.Span, ids remoteContext, header http.Header) {
+	header.Set(TraceIDHeaderKey, ids.amznTraceID())
+}
+
+// spanIDs returns the trace and span IDs of sc as lowercase hex. OpenTracing doesn't expose
+// IDs, so the context is injected as a text map and read back in the formats of the common
+// tracers: LightStep and basictracer, mocktracer, Zipkin B3, Jaeger and X-Ray.
+func spanIDs(tracer opentracing.Tracer, sc opentracing.SpanContext) (remoteContext, error) {
+	carrier := opentracing.TextMapCarrier{}
+	if err := tracer.Inject(sc, opentracing.TextMap, carrier); err != nil {
+		return remoteContext{}, err
+	}
+	fields := make(map[string]string, len(carrier))
+	for k, v := range carrier {
+		fields[strings.ToLower(k)] = v
+	}
+
+	ids := remoteContext{Sampled: true}
+	var err error
+	switch {
+	case fields[otTraceIDHeaderKey] != "":
+		ids.TraceID, ids.SpanID = fields[otTraceIDHeaderKey], fields[otSpanIDHeaderKey]
+		if v, ok := fields[otSampledHeaderKey]; ok {
+			ids.Sampled, _ = strconv.ParseBool(v)
+		}
+	case fields["mockpfx-ids-traceid"] != "":
+		if ids.TraceID, err = decimalHex(fields["mockpfx-ids-traceid"]); err == nil {
+			ids.SpanID, err = decimalHex(fields["mockpfx-ids-spanid"])
+		}
+		if v, ok := fields["mockpfx-ids-sampled"]; ok {
+			ids.Sampled, _ = strconv.ParseBool(v)
+		}
+	case fields[b3TraceIDHeaderKey] != "":
+		ids.TraceID, ids.SpanID = fields[b3TraceIDHeaderKey], fields[b3SpanIDHeaderKey]
+		if v, ok := fields[b3SampledHeaderKey]; ok {
+			ids.Sampled = v == "1" || v == "true"
+		}
+	case fields["uber-trace-id"] != "":
+		// traceid:spanid:parentid:flags
+		parts := strings.Split(fields["uber-trace-id"], ":")
+		if len(parts) != 4 {
+			return remoteContext{}, opentracing.ErrSpanContextCorrupted
+		}
+		ids.TraceID, ids.SpanID = parts[0], parts[1]
+		flags, _ := strconv.ParseUint(parts[3], 16, 8)
+		ids.Sampled = flags&1 == 1
+	case fields[TraceIDHeaderKey] != "":
+		rc, ok := parseAmznTraceID(fields[TraceIDHeaderKey])
+		if !ok {
+			return remoteContext{}, opentracing.ErrSpanContextCorrupted
+		}
+		ids = rc
+	default:
+		return remoteContext{}, opentracing.ErrUnsupportedFormat
+	}
+	if err != nil {
+		return remoteContext{}, opentracing.ErrSpanContextCorrupted
+	}
+
+	ids.TraceID, ids.SpanID = strings.ToLower(ids.TraceID), strings.ToLower(ids.SpanID)
+	if ids.TraceID == "" || ids.SpanID == "" || len(ids.TraceID) > 32 || len(ids.SpanID) > 16 || !isHex(ids.TraceID+ids.SpanID) {
+		return remoteContext{}, opentracing.ErrSpanContextCorrupted
+	}
+	return ids, nil
+}
+
+func decimalHex(s string) (string, error) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(n, 16), nil
+}
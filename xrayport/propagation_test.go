@@ -0,0 +1,65 @@
+package xrayport_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestPropagation(t *testing.T) {
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer srv.Close()
+
+	root := tracer.StartSpan("requestObject")
+	root.SetBaggageItem("tracestate", "vendor=1")
+	ctx := opentracing.ContextWithSpan(context.Background(), root)
+
+	hc := xrayport.Client(nil, xrayport.WithPropagators(xrayport.W3C, xrayport.B3, xrayport.XRay))
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	var span *mocktracer.MockSpan
+	for _, s := range tracer.FinishedSpans() {
+		if s.ParentID == root.(*mocktracer.MockSpan).SpanContext.SpanID {
+			span = s
+		}
+	}
+	if span == nil {
+		t.Fatal("Missing request span")
+	}
+	traceID := fmt.Sprintf("%032x", span.SpanContext.TraceID)
+	spanID := fmt.Sprintf("%016x", span.SpanContext.SpanID)
+
+	expected := map[string]string{
+		"Traceparent":     "00-" + traceID + "-" + spanID + "-01",
+		"Tracestate":      "vendor=1",
+		"X-B3-Traceid":    fmt.Sprintf("%x", span.SpanContext.TraceID),
+		"X-B3-Spanid":     fmt.Sprintf("%x", span.SpanContext.SpanID),
+		"X-B3-Sampled":    "1",
+		"X-Amzn-Trace-Id": "Root=1-" + traceID[:8] + "-" + traceID[8:] + ";Parent=" + spanID + ";Sampled=1",
+	}
+	for k, v := range expected {
+		if header.Get(k) != v {
+			t.Errorf("%v was %q instead of %q", k, header.Get(k), v)
+		}
+	}
+	if header.Get("Mockpfx-Ids-Traceid") != "" {
+		t.Error("Unexpected OpenTracing headers")
+	}
+}
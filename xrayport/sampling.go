@@ -0,0 +1,207 @@
+package xrayport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SamplingRule matches requests by host, HTTP method, URL path and AWS service and
+// operation, each a case insensitive pattern where * matches any characters and ? any one.
+// An empty pattern matches anything. FixedTarget requests a second are sampled, the
+// reservoir, then Rate of those beyond it.
+type SamplingRule struct {
+	Description string  `json:"description"`
+	Host        string  `json:"host"`
+	HTTPMethod  string  `json:"http_method"`
+	URLPath     string  `json:"url_path"`
+	Service     string  `json:"service"`
+	Operation   string  `json:"operation"`
+	FixedTarget int     `json:"fixed_target"`
+	Rate        float64 `json:"rate"`
+
+	mu     sync.Mutex
+	second int64
+	used   int
+}
+
+// SamplingRules is the X-Ray local sampling rules document, version 2, with service and
+// operation patterns added for AWS calls. Rules are tried in order, then the default.
+type SamplingRules struct {
+	Version int             `json:"version"`
+	Rules   []*SamplingRule `json:"rules"`
+	Default *SamplingRule   `json:"default"`
+}
+
+// SamplingRequest is what a sampling decision is made on, fields that aren't known are empty
+type SamplingRequest struct {
+	Host      string
+	Method    string
+	URLPath   string
+	Service   string
+	Operation string
+}
+
+// Sampler decides which requests are traced. A nil Sampler traces everything.
+type Sampler struct {
+	rules []*SamplingRule
+}
+
+// NewSampler returns a Sampler for the sampling rules document in data
+func NewSampler(data []byte) (*Sampler, error) {
+	var sr SamplingRules
+	if err := json.Unmarshal(data, &sr); err != nil {
+		return nil, fmt.Errorf("Bad sampling rules: %v", err.Error())
+	}
+	if sr.Version != 2 {
+		return nil, fmt.Errorf("Bad sampling rules version %v", sr.Version)
+	}
+	if sr.Default == nil {
+		return nil, fmt.Errorf("Bad sampling rules: missing default")
+	}
+	if sr.Default.Host != "" || sr.Default.HTTPMethod != "" || sr.Default.URLPath != "" || sr.Default.Service != "" || sr.Default.Operation != "" {
+		return nil, fmt.Errorf("Bad sampling rules: default can only set fixed_target and rate")
+	}
+	rules := append(sr.Rules, sr.Default)
+	for i, rule := range rules {
+		if rule == nil || rule.FixedTarget < 0 || rule.Rate < 0 || rule.Rate > 1 {
+			return nil, fmt.Errorf("Bad sampling rule %v", i)
+		}
+	}
+	return &Sampler{rules: rules}, nil
+}
+
+// LoadSampler returns a Sampler for the sampling rules in the file
+func LoadSampler(filename string) (*Sampler, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewSampler(data)
+}
+
+// Sample decides whether to trace req with the first rule it matches
+func (s *Sampler) Sample(req SamplingRequest) bool {
+	if s == nil {
+		return true
+	}
+	for _, rule := range s.rules {
+		if rule.matches(req) {
+			return rule.sample(time.Now())
+		}
+	}
+	return true
+}
+
+func (r *SamplingRule) matches(req SamplingRequest) bool {
+	return wildcardMatch(r.Host, req.Host) &&
+		wildcardMatch(r.HTTPMethod, req.Method) &&
+		wildcardMatch(r.URLPath, req.URLPath) &&
+		wildcardMatch(r.Service, req.Service) &&
+		wildcardMatch(r.Operation, req.Operation)
+}
+
+// sample takes from the reservoir for the current second, falling back to the rate
+func (r *SamplingRule) sample(now time.Time) bool {
+	r.mu.Lock()
+	if sec := now.Unix(); sec != r.second {
+		r.second, r.used = sec, 0
+	}
+	if r.used < r.FixedTarget {
+		r.used++
+		r.mu.Unlock()
+		return true
+	}
+	r.mu.Unlock()
+	return rand.Float64() < r.Rate
+}
+
+// wildcardMatch matches text against a pattern of * and ? ignoring case, an empty pattern
+// matches anything
+func wildcardMatch(pattern, text string) bool {
+	if pattern == "" {
+		return true
+	}
+	p, t := strings.ToLower(pattern), strings.ToLower(text)
+	star, mark := -1, 0
+	i, j := 0, 0
+	for j < len(t) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == t[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, mark = i, j
+			i++
+		case star >= 0:
+			i = star + 1
+			mark++
+			j = mark
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+type samplingKey struct{}
+
+// WithSamplingDecision returns a context carrying the decision whether to trace. Client,
+// AWS, AWSV2, GCS and Capture keep to a decision in their context rather than making
+// their own, and leave out their spans when it is not to trace.
+func WithSamplingDecision(ctx context.Context, sampled bool) context.Context {
+	return context.WithValue(ctx, samplingKey{}, sampled)
+}
+
+// SamplingDecision returns the decision in ctx and whether there is one
+func SamplingDecision(ctx context.Context) (sampled, ok bool) {
+	sampled, ok = ctx.Value(samplingKey{}).(bool)
+	return sampled, ok
+}
+
+// notSampled reports whether ctx carries a decision not to trace
+func notSampled(ctx context.Context) bool {
+	sampled, ok := SamplingDecision(ctx)
+	return ok && !sampled
+}
+
+// decide returns the decision in ctx, or makes one with s and adds it to ctx for the
+// children of the call. Without a decision or sampler everything is traced.
+func decide(ctx context.Context, s *Sampler, req SamplingRequest) (context.Context, bool) {
+	if sampled, ok := SamplingDecision(ctx); ok {
+		return ctx, sampled
+	}
+	if s == nil {
+		return ctx, true
+	}
+	sampled := s.Sample(req)
+	return WithSamplingDecision(ctx, sampled), sampled
+}
+
+// WithSampler makes the client decide which of its calls are traced with s, unless the
+// call's context already carries a decision. Requests are matched on their host, method
+// and path, and AWS calls on their service and operation too. AWS and AWSV2 decide once
+// the request is built, so the path has the bucket and key. Calls that aren't traced send
+// the decision in their trace headers.
+func WithSampler(s *Sampler) ClientOption {
+	return func(c *clientConfig) {
+		c.sampler = s
+	}
+}
+
+// Sample makes Capture decide with s whether to trace req, unless ctx already carries a
+// decision, which is then passed on to fn's context
+func Sample(s *Sampler, req SamplingRequest) CaptureOption {
+	return func(c *captureConfig) {
+		c.sampler = s
+		c.samplingRequest = req
+	}
+}
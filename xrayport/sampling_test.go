@@ -0,0 +1,249 @@
+package xrayport_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	s3v2 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestSampling(t *testing.T) {
+	for _, rules := range []string{
+		`{"version": 1, "default": {"fixed_target": 1, "rate": 0.1}}`,
+		`{"version": 2, "rules": []}`,
+		`{"version": 2, "default": {"fixed_target": 1, "rate": 1.5}}`,
+		`{"version": 2, "default": {"host": "*", "fixed_target": 1, "rate": 0.1}}`,
+	} {
+		if _, err := xrayport.NewSampler([]byte(rules)); err == nil {
+			t.Errorf("Missing error for %v", rules)
+		}
+	}
+
+	s, err := xrayport.NewSampler([]byte(`{
+		"version": 2,
+		"rules": [
+			{"description": "reads", "service": "s3", "operation": "Get*", "fixed_target": 2, "rate": 0},
+			{"description": "health", "host": "*.example.com", "url_path": "/health?", "fixed_target": 0, "rate": 0}
+		],
+		"default": {"fixed_target": 0, "rate": 1}
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// The reservoir is per second, so retry should the second change during the reads
+	for {
+		sec := time.Now().Unix()
+		sampled := 0
+		for i := 0; i < 3; i++ {
+			if s.Sample(xrayport.SamplingRequest{Service: "s3", Operation: "GetObject"}) {
+				sampled++
+			}
+		}
+		if time.Now().Unix() != sec {
+			continue
+		}
+		if sampled != 2 {
+			t.Errorf("Sampled %v reads instead of the reservoir of 2", sampled)
+		}
+		break
+	}
+
+	if s.Sample(xrayport.SamplingRequest{Host: "api.Example.com", URLPath: "/health1"}) {
+		t.Errorf("Unexpected sampling of health check")
+	}
+	if !s.Sample(xrayport.SamplingRequest{Host: "api.example.com", URLPath: "/health12"}) {
+		t.Errorf("Unexpected default rule not sampling")
+	}
+	if !s.Sample(xrayport.SamplingRequest{Service: "s3", Operation: "PutObject"}) {
+		t.Errorf("Unexpected default rule not sampling")
+	}
+
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	never, _ := xrayport.NewSampler([]byte(`{"version": 2, "default": {"fixed_target": 0, "rate": 0}}`))
+	var headers http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+	hc := xrayport.Client(nil, xrayport.WithSampler(never))
+
+	for _, decision := range []string{"", "sampled"} {
+		tracer.Reset()
+		root := tracer.StartSpan("requestObject")
+		ctx := opentracing.ContextWithSpan(context.Background(), root)
+		if decision == "sampled" {
+			ctx = xrayport.WithSamplingDecision(ctx, true)
+		}
+
+		err := xrayport.GCS(ctx, "NewReader", "bucket", "object", func(ctx context.Context) error {
+			// The children of the operation keep to its decision
+			return xrayport.Capture(ctx, "read", func(ctx context.Context) error {
+				req, _ := http.NewRequest("GET", srv.URL, nil)
+				resp, err := hc.Do(req.WithContext(ctx))
+				if err != nil {
+					return err
+				}
+				ioutil.ReadAll(resp.Body)
+				return resp.Body.Close()
+			})
+		}, xrayport.Sample(never, xrayport.SamplingRequest{Service: "gcs", Operation: "NewReader"}))
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		root.Finish()
+
+		// Calls that aren't traced still pass the decision on
+		spans := tracer.FinishedSpans()
+		traced := headers.Get("Mockpfx-Ids-Sampled")
+		if decision == "" && (len(spans) != 1 || traced != "false") {
+			t.Errorf("Unexpected %v spans and sampled header %q without sampling", len(spans), traced)
+		}
+		if decision == "sampled" && (len(spans) < 5 || traced != "true") {
+			t.Errorf("Unexpected %v spans and sampled header %q when sampled", len(spans), traced)
+		}
+	}
+}
+
+func TestSamplingAWSV2(t *testing.T) {
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	var headers http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	// Objects in the skipped bucket are only known by the path of the built request
+	s, err := xrayport.NewSampler([]byte(`{
+		"version": 2,
+		"rules": [{"description": "skipped", "http_method": "GET", "url_path": "/skipped/*", "service": "s3", "fixed_target": 0, "rate": 0}],
+		"default": {"fixed_target": 0, "rate": 1}
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	cfg := newS3V2(srv.URL)
+	xrayport.AWSV2(&cfg, xrayport.WithSampler(s), xrayport.WithPropagators(xrayport.OpenTracing, xrayport.XRay))
+	svc := s3v2.NewFromConfig(cfg, func(o *s3v2.Options) {
+		o.UsePathStyle = true
+	})
+
+	for _, bucket := range []string{"skipped", "objcheck-us-east-1"} {
+		tracer.Reset()
+		root := tracer.StartSpan("requestObject")
+		ctx := opentracing.ContextWithSpan(context.Background(), root)
+		out, err := svc.GetObject(ctx, &s3v2.GetObjectInput{Bucket: awsv2.String(bucket), Key: awsv2.String("10_1_1k.obj")})
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		ioutil.ReadAll(out.Body)
+		out.Body.Close()
+		root.Finish()
+
+		spans := tracer.FinishedSpans()
+		xray := headers.Get(xrayport.TraceIDHeaderKey)
+		if bucket == "skipped" {
+			if len(spans) != 1 || headers.Get("Mockpfx-Ids-Sampled") != "false" || !strings.HasSuffix(xray, "Sampled=0") {
+				t.Errorf("Unexpected %v spans and headers %v without sampling", len(spans), headers)
+			}
+			continue
+		}
+
+		op := operationSpan(t, tracer)
+		if op.ParentID != root.(*mocktracer.MockSpan).SpanContext.SpanID || op.Tag("bucket_name") != bucket {
+			t.Errorf("Unexpected operation span %+v", op)
+		}
+		marshalled := false
+		for _, span := range spans {
+			if span.OperationName == "marshal" && span.ParentID == op.SpanContext.SpanID {
+				marshalled = !span.StartTime.Before(op.StartTime)
+			}
+		}
+		if !marshalled {
+			t.Errorf("Missing marshal span of operation")
+		}
+		if headers.Get("Mockpfx-Ids-Sampled") != "true" || !strings.HasSuffix(xray, "Sampled=1") {
+			t.Errorf("Unexpected headers %v when sampled", headers)
+		}
+	}
+}
+
+func TestSamplingAWS(t *testing.T) {
+	tracer, restore := useMockTracer()
+	defer restore()
+
+	var headers http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	// Objects in the skipped bucket are only known by the path of the built request
+	s, err := xrayport.NewSampler([]byte(`{
+		"version": 2,
+		"rules": [{"description": "skipped", "http_method": "GET", "url_path": "/skipped/*", "service": "s3", "fixed_target": 0, "rate": 0}],
+		"default": {"fixed_target": 0, "rate": 1}
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	svc := newS3(t, srv.URL)
+	xrayport.AWS(svc.Client, xrayport.WithSampler(s), xrayport.WithPropagators(xrayport.OpenTracing, xrayport.XRay))
+
+	for _, bucket := range []string{"skipped", "objcheck-us-east-1"} {
+		tracer.Reset()
+		root := tracer.StartSpan("requestObject")
+		ctx := opentracing.ContextWithSpan(context.Background(), root)
+		out, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String("10_1_1k.obj")})
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		ioutil.ReadAll(out.Body)
+		out.Body.Close()
+		root.Finish()
+
+		spans := tracer.FinishedSpans()
+		xray := headers.Get(xrayport.TraceIDHeaderKey)
+		if bucket == "skipped" {
+			if len(spans) != 1 || headers.Get("Mockpfx-Ids-Sampled") != "false" || !strings.HasSuffix(xray, "Sampled=0") {
+				t.Errorf("Unexpected %v spans and headers %v without sampling", len(spans), headers)
+			}
+			continue
+		}
+
+		op := operationSpan(t, tracer)
+		if op.ParentID != root.(*mocktracer.MockSpan).SpanContext.SpanID || op.Tag("bucket_name") != bucket {
+			t.Errorf("Unexpected operation span %+v", op)
+		}
+		children := make(map[string]bool)
+		for _, span := range spans {
+			if span.ParentID == op.SpanContext.SpanID {
+				children[span.OperationName] = true
+			}
+		}
+		if !children["marshal"] || !children["attempt"] || !children["unmarshal"] {
+			t.Errorf("Operation has subsegments %v", children)
+		}
+		if headers.Get("Mockpfx-Ids-Sampled") != "true" || !strings.HasSuffix(xray, "Sampled=1") {
+			t.Errorf("Unexpected headers %v when sampled", headers)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package xrayport
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// daemonHeader starts every UDP packet sent to the X-Ray daemon
+const daemonHeader = "{\"format\": \"json\", \"version\": 1}\n"
+
+// maxSegmentSize keeps a packet within the daemon's 64KB limit
+const maxSegmentSize = 63 * 1024
+
+// segmentDocument is an X-Ray segment or subsegment document
+type segmentDocument struct {
+	Name        string                            `json:"name"`
+	ID          string                            `json:"id"`
+	TraceID     string                            `json:"trace_id,omitempty"`
+	ParentID    string                            `json:"parent_id,omitempty"`
+	Type        string                            `json:"type,omitempty"`
+	StartTime   float64                           `json:"start_time"`
+	EndTime     float64                           `json:"end_time,omitempty"`
+	InProgress  bool                              `json:"in_progress,omitempty"`
+	Namespace   string                            `json:"namespace,omitempty"`
+	Error       bool                              `json:"error,omitempty"`
+	Fault       bool                              `json:"fault,omitempty"`
+	Throttle    bool                              `json:"throttle,omitempty"`
+	Cause       *causeDocument                    `json:"cause,omitempty"`
+	HTTP        *httpDocument                     `json:"http,omitempty"`
+	AWS         map[string]interface{}            `json:"aws,omitempty"`
+	Annotations map[string]interface{}            `json:"annotations,omitempty"`
+	Metadata    map[string]map[string]interface{} `json:"metadata,omitempty"`
+	Subsegments []*segmentDocument                `json:"subsegments,omitempty"`
+}
+
+type causeDocument struct {
+	Exceptions []exceptionDocument `json:"exceptions"`
+}
+
+type exceptionDocument struct {
+	ID      string `json:"id"`
+	Type    string `json:"type,omitempty"`
+	Message string `json:"message"`
+}
+
+type httpDocument struct {
+	Request  *httpRequestDocument  `json:"request,omitempty"`
+	Response *httpResponseDocument `json:"response,omitempty"`
+}
+
+type httpRequestDocument struct {
+	Method   string `json:"method,omitempty"`
+	URL      string `json:"url,omitempty"`
+	ClientIP string `json:"client_ip,omitempty"`
+}
+
+type httpResponseDocument struct {
+	Status        int `json:"status,omitempty"`
+	ContentLength int `json:"content_length,omitempty"`
+}
+
+// awsTagKeys maps the tags AWS and AWSV2 set on operation spans to X-Ray's aws field names
+var awsTagKeys = map[string]string{
+	"operation":         "operation",
+	"region":            "region",
+	"retries":           "retries",
+	"RequestID":         "request_id",
+	"ExtendedRequestID": "id_2",
+}
+
+var (
+	badNameChars       = regexp.MustCompile(`[^\pL\pN\s_.:/%&#=+\\@-]`)
+	badAnnotationChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+func epochSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// document converts the span and its children to a segment document, the trace must be locked
+func (s *span) document() *segmentDocument {
+	doc := &segmentDocument{
+		Name:      badNameChars.ReplaceAllString(s.name, "_"),
+		ID:        s.context.SpanID,
+		StartTime: epochSeconds(s.start),
+	}
+	if len(doc.Name) > 200 {
+		doc.Name = doc.Name[:200]
+	}
+	if s.end.IsZero() {
+		doc.InProgress = true
+	} else {
+		doc.EndTime = epochSeconds(s.end)
+	}
+
+	namespace, _ := s.tags["namespace"].(string)
+	doc.Namespace = namespace
+
+	var req httpRequestDocument
+	var resp httpResponseDocument
+	failed := false
+	errorKind := ""
+	for k, v := range s.tags {
+		switch k {
+		case "namespace", "span.kind", "error.message":
+		case "error.kind":
+			errorKind = fmt.Sprint(v)
+		case "http.method":
+			req.Method = fmt.Sprint(v)
+		case "http.url":
+			req.URL = fmt.Sprint(v)
+		case "peer.address":
+			req.ClientIP = fmt.Sprint(v)
+		case "http.status_code":
+			resp.Status = intTag(v)
+		case "ContentLength":
+			resp.ContentLength = intTag(v)
+		case "error":
+			failed, _ = v.(bool)
+		case "Throttle":
+			doc.Throttle, _ = v.(bool)
+		default:
+			if namespace == "aws" {
+				if doc.AWS == nil {
+					doc.AWS = make(map[string]interface{})
+				}
+				if name, ok := awsTagKeys[k]; ok {
+					k = name
+				}
+				doc.AWS[k] = v
+				continue
+			}
+			switch v.(type) {
+			case string, bool, int, int32, int64, uint, uint16, uint32, uint64, float32, float64:
+				if doc.Annotations == nil {
+					doc.Annotations = make(map[string]interface{})
+				}
+				doc.Annotations[badAnnotationChars.ReplaceAllString(k, "_")] = v
+			default:
+				doc.setMetadata(k, v)
+			}
+		}
+	}
+	if req != (httpRequestDocument{}) || resp != (httpResponseDocument{}) {
+		doc.HTTP = &httpDocument{}
+		if req != (httpRequestDocument{}) {
+			doc.HTTP.Request = &req
+		}
+		if resp != (httpResponseDocument{}) {
+			doc.HTTP.Response = &resp
+		}
+	}
+
+	// As in the X-Ray SDK, 4xx responses are errors, 429 also a throttle, and 5xx are faults
+	switch {
+	case resp.Status == 429:
+		doc.Error, doc.Throttle = true, true
+	case resp.Status >= 400 && resp.Status < 500:
+		doc.Error = true
+	case resp.Status >= 500 || failed:
+		doc.Fault = true
+	}
+	if doc.Throttle {
+		doc.Error = true
+	}
+
+	var logs []map[string]interface{}
+	for _, lr := range s.logs {
+		entry := map[string]interface{}{"timestamp": epochSeconds(lr.Timestamp)}
+		for _, f := range lr.Fields {
+			if f.Key() == "error" || f.Key() == "errors" {
+				if doc.Cause == nil {
+					doc.Cause = &causeDocument{}
+				}
+				doc.Cause.Exceptions = append(doc.Cause.Exceptions, exceptionDocument{ID: newID(8), Type: errorKind, Message: fmt.Sprint(f.Value())})
+			}
+			if err, ok := f.Value().(error); ok {
+				entry[f.Key()] = err.Error()
+			} else {
+				entry[f.Key()] = jsonValue(f.Value())
+			}
+		}
+		logs = append(logs, entry)
+	}
+	if logs != nil {
+		doc.setMetadata("logs", logs)
+	}
+
+	for _, child := range s.children {
+		doc.Subsegments = append(doc.Subsegments, child.document())
+	}
+	return doc
+}
+
+func (doc *segmentDocument) setMetadata(k string, v interface{}) {
+	if doc.Metadata == nil {
+		doc.Metadata = map[string]map[string]interface{}{"default": {}}
+	}
+	doc.Metadata["default"][k] = jsonValue(v)
+}
+
+// jsonValue returns v, or its string form if it can't be written as JSON
+func jsonValue(v interface{}) interface{} {
+	if _, err := json.Marshal(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+// identify adds the trace and parent IDs a top level document needs, independent marks a
+// subsegment sent on its own after its segment
+func (s *span) identify(doc *segmentDocument, independent bool) {
+	doc.TraceID = fmt.Sprintf("1-%s-%s", s.context.TraceID[:8], s.context.TraceID[8:])
+	doc.ParentID = s.parentID
+	if independent {
+		doc.Type = "subsegment"
+	}
+}
+
+// documents returns the packets sending the span and its children. A tree too big for one
+// packet is split, with each child sent as an independent subsegment. A span still too big
+// on its own loses its metadata, cause and then annotations, and is marked truncated.
+func (s *span) documents(independent bool) [][]byte {
+	doc := s.document()
+	s.identify(doc, independent)
+	if packet, err := marshalPacket(doc); err == nil && len(packet) <= maxSegmentSize {
+		return [][]byte{packet}
+	}
+
+	doc.Subsegments = nil
+	packet, err := marshalPacket(doc)
+	if err == nil && len(packet) > maxSegmentSize {
+		doc.Metadata, doc.Cause = nil, nil
+		if doc.Annotations == nil {
+			doc.Annotations = make(map[string]interface{})
+		}
+		doc.Annotations["truncated"] = true
+		packet, err = marshalPacket(doc)
+	}
+	if err == nil && len(packet) > maxSegmentSize {
+		doc.Annotations = map[string]interface{}{"truncated": true}
+		packet, err = marshalPacket(doc)
+	}
+	var packets [][]byte
+	if err == nil && len(packet) <= maxSegmentSize {
+		packets = append(packets, packet)
+	}
+	for _, child := range s.children {
+		packets = append(packets, child.documents(true)...)
+	}
+	return packets
+}
+
+func marshalPacket(doc *segmentDocument) ([]byte, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(daemonHeader), data...), nil
+}
+
+// emit sends a packet to the daemon, dropping it on error like the X-Ray SDK does
+func (t *Tracer) emit(packet []byte) {
+	t.conn.Write(packet)
+}
+
+func intTag(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case uint16:
+		return int(n)
+	case int64:
+		return int(n)
+	case uint64:
+		return int(n)
+	case int32:
+		return int(n)
+	case uint32:
+		return int(n)
+	case string:
+		var i int
+		fmt.Sscan(strings.TrimSpace(n), &i)
+		return i
+	}
+	return 0
+}
@@ -0,0 +1,341 @@
+package xrayport
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// DefaultDaemonAddress is where the X-Ray daemon listens for segments unless
+// AWS_XRAY_DAEMON_ADDRESS says otherwise
+const DefaultDaemonAddress = "127.0.0.1:2000"
+
+// TracerOptions configures NewTracer
+type TracerOptions struct {
+	// DaemonAddress is the UDP address of the X-Ray daemon, defaulting to
+	// AWS_XRAY_DAEMON_ADDRESS or DefaultDaemonAddress
+	DaemonAddress string
+	// Tags are added as annotations to each segment
+	Tags opentracing.Tags
+}
+
+// Tracer is an OpenTracing tracer that reports spans to AWS X-Ray. Each tree of spans
+// started in the process is sent as a segment document to the X-Ray daemon when its root
+// span finishes, with the child spans as subsegments. Spans tagged by AWS, AWSV2, Client
+// and GCS fill in the segment's namespace, aws and http fields, other tags become
+// annotations and metadata. Trace context is propagated in the X-Amzn-Trace-Id header.
+type Tracer struct {
+	conn net.Conn
+	tags opentracing.Tags
+}
+
+// NewTracer returns a Tracer sending segments to the X-Ray daemon
+func NewTracer(opts TracerOptions) (*Tracer, error) {
+	addr := opts.DaemonAddress
+	if addr == "" {
+		addr = os.Getenv("AWS_XRAY_DAEMON_ADDRESS")
+	}
+	if addr == "" {
+		addr = DefaultDaemonAddress
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Bad X-Ray daemon address %v: %v", addr, err.Error())
+	}
+	return &Tracer{conn: conn, tags: opts.Tags}, nil
+}
+
+// Close closes the connection to the daemon
+func (t *Tracer) Close() error {
+	return t.conn.Close()
+}
+
+// SpanContext is the context of a Tracer span, IDs are lowercase hex with the trace ID
+// holding the 32 digits of an X-Ray trace ID without its dashes
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+	Sampled bool
+	Baggage map[string]string
+
+	span *span
+}
+
+// ForeachBaggageItem implements opentracing.SpanContext
+func (sc SpanContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for k, v := range sc.Baggage {
+		if !handler(k, v) {
+			break
+		}
+	}
+}
+
+func (sc SpanContext) withBaggageItem(key, value string) SpanContext {
+	baggage := make(map[string]string, len(sc.Baggage)+1)
+	for k, v := range sc.Baggage {
+		baggage[k] = v
+	}
+	baggage[key] = value
+	sc.Baggage = baggage
+	return sc
+}
+
+// amznTraceID formats the context as an X-Amzn-Trace-Id header, with the baggage
+// appended as extra fields
+func (sc SpanContext) amznTraceID() string {
+	h := remoteContext{TraceID: sc.TraceID, SpanID: sc.SpanID, Sampled: sc.Sampled}.amznTraceID()
+	for k, v := range sc.Baggage {
+		h += ";" + k + "=" + v
+	}
+	return h
+}
+
+// newID returns n random bytes as hex
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newTraceID returns an X-Ray trace ID, which begins with the epoch seconds of its start
+func newTraceID(start time.Time) string {
+	return fmt.Sprintf("%08x", start.Unix()) + newID(12)
+}
+
+// StartSpan implements opentracing.Tracer
+func (t *Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	var sso opentracing.StartSpanOptions
+	for _, o := range opts {
+		o.Apply(&sso)
+	}
+	if sso.StartTime.IsZero() {
+		sso.StartTime = time.Now()
+	}
+
+	s := &span{
+		tracer: t,
+		name:   operationName,
+		start:  sso.StartTime,
+		tags:   make(map[string]interface{}),
+	}
+	for k, v := range sso.Tags {
+		s.tags[k] = v
+	}
+
+	var parent *SpanContext
+	for _, ref := range sso.References {
+		if sc, ok := ref.ReferencedContext.(SpanContext); ok && (parent == nil || ref.Type == opentracing.ChildOfRef) {
+			parent = &sc
+		}
+	}
+
+	if parent == nil {
+		s.context = SpanContext{TraceID: newTraceID(s.start), Sampled: true}
+		s.trace = &localTrace{}
+		for k, v := range t.tags {
+			s.tags[k] = v
+		}
+	} else {
+		s.context = SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled, Baggage: parent.Baggage}
+		s.parentID = parent.SpanID
+		if p := parent.span; p != nil {
+			s.trace = p.trace
+			s.parent = p
+		} else {
+			// Continues a remote trace, so is the root of a segment here
+			s.trace = &localTrace{}
+			for k, v := range t.tags {
+				s.tags[k] = v
+			}
+		}
+	}
+	s.context.SpanID = newID(8)
+	s.context.span = s
+
+	if s.parent != nil {
+		s.trace.mu.Lock()
+		s.parent.children = append(s.parent.children, s)
+		s.trace.mu.Unlock()
+	}
+	return s
+}
+
+// Inject implements opentracing.Tracer, writing the X-Amzn-Trace-Id header to HTTPHeaders
+// and TextMap carriers
+func (t *Tracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	sc, ok := sm.(SpanContext)
+	if !ok {
+		return opentracing.ErrInvalidSpanContext
+	}
+	if format != opentracing.HTTPHeaders && format != opentracing.TextMap {
+		return opentracing.ErrUnsupportedFormat
+	}
+	w, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+	w.Set(TraceIDHeaderKey, sc.amznTraceID())
+	return nil
+}
+
+// Extract implements opentracing.Tracer, reading the X-Amzn-Trace-Id header
+func (t *Tracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	if format != opentracing.HTTPHeaders && format != opentracing.TextMap {
+		return nil, opentracing.ErrUnsupportedFormat
+	}
+	r, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return nil, opentracing.ErrInvalidCarrier
+	}
+
+	var header string
+	err := r.ForeachKey(func(k, v string) error {
+		if strings.EqualFold(k, TraceIDHeaderKey) {
+			header = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if header == "" {
+		return nil, opentracing.ErrSpanContextNotFound
+	}
+	rc, ok := parseAmznTraceID(header)
+	if !ok {
+		return nil, opentracing.ErrSpanContextCorrupted
+	}
+	return SpanContext{TraceID: rc.TraceID, SpanID: rc.SpanID, Sampled: rc.Sampled, Baggage: rc.Baggage}, nil
+}
+
+// localTrace is the tree of spans in this process under one segment, locked as a whole
+type localTrace struct {
+	mu   sync.Mutex
+	sent bool
+}
+
+// span is a Tracer span
+type span struct {
+	tracer   *Tracer
+	trace    *localTrace
+	parent   *span
+	parentID string
+	context  SpanContext
+	name     string
+	start    time.Time
+	end      time.Time
+	tags     map[string]interface{}
+	logs     []opentracing.LogRecord
+	children []*span
+}
+
+func (s *span) Finish() {
+	s.FinishWithOptions(opentracing.FinishOptions{})
+}
+
+func (s *span) FinishWithOptions(opts opentracing.FinishOptions) {
+	if opts.FinishTime.IsZero() {
+		opts.FinishTime = time.Now()
+	}
+
+	s.trace.mu.Lock()
+	if !s.end.IsZero() {
+		s.trace.mu.Unlock()
+		return
+	}
+	s.end = opts.FinishTime
+	for _, lr := range opts.LogRecords {
+		s.logs = append(s.logs, lr)
+	}
+	var docs [][]byte
+	if s.context.Sampled {
+		switch {
+		case s.parent == nil:
+			s.trace.sent = true
+			docs = s.documents(false)
+		case s.trace.sent:
+			// The segment has gone, so this is sent as an independent subsegment
+			docs = s.documents(true)
+		}
+	}
+	s.trace.mu.Unlock()
+
+	for _, doc := range docs {
+		s.tracer.emit(doc)
+	}
+}
+
+func (s *span) Context() opentracing.SpanContext {
+	s.trace.mu.Lock()
+	defer s.trace.mu.Unlock()
+	return s.context
+}
+
+func (s *span) SetOperationName(operationName string) opentracing.Span {
+	s.trace.mu.Lock()
+	s.name = operationName
+	s.trace.mu.Unlock()
+	return s
+}
+
+func (s *span) SetTag(key string, value interface{}) opentracing.Span {
+	s.trace.mu.Lock()
+	s.tags[key] = value
+	s.trace.mu.Unlock()
+	return s
+}
+
+func (s *span) LogFields(fields ...log.Field) {
+	s.trace.mu.Lock()
+	s.logs = append(s.logs, opentracing.LogRecord{Timestamp: time.Now(), Fields: fields})
+	s.trace.mu.Unlock()
+}
+
+func (s *span) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := log.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		return
+	}
+	s.LogFields(fields...)
+}
+
+func (s *span) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	s.trace.mu.Lock()
+	s.context = s.context.withBaggageItem(restrictedKey, value)
+	s.trace.mu.Unlock()
+	return s
+}
+
+func (s *span) BaggageItem(restrictedKey string) string {
+	s.trace.mu.Lock()
+	defer s.trace.mu.Unlock()
+	return s.context.Baggage[restrictedKey]
+}
+
+func (s *span) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+// Deprecated OpenTracing span methods
+
+func (s *span) LogEvent(event string) {
+	s.LogFields(log.String("event", event))
+}
+
+func (s *span) LogEventWithPayload(event string, payload interface{}) {
+	s.LogFields(log.String("event", event), log.Object("payload", payload))
+}
+
+func (s *span) Log(ld opentracing.LogData) {
+	s.trace.mu.Lock()
+	s.logs = append(s.logs, ld.ToLogRecord())
+	s.trace.mu.Unlock()
+}
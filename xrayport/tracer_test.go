@@ -0,0 +1,168 @@
+package xrayport_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1mentat/saastrace_aafunc/xrayport"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+func TestXRayTracer(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer conn.Close()
+
+	tracer, err := xrayport.NewTracer(xrayport.TracerOptions{
+		DaemonAddress: conn.LocalAddr().String(),
+		Tags:          opentracing.Tags{"version": "v1"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer tracer.Close()
+
+	header := http.Header{"X-Amzn-Trace-Id": {"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"}}
+	parent, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	root := tracer.StartSpan("ObjCheck", ext.RPCServerOption(parent))
+	ext.HTTPMethod.Set(root, "POST")
+	ext.HTTPStatusCode.Set(root, 200)
+	root.SetTag("service", "s3")
+
+	op := tracer.StartSpan("s3", opentracing.ChildOf(root.Context()))
+	op.SetTag("namespace", "aws")
+	op.SetTag("operation", "GetObject")
+	op.SetTag("RequestID", "req-1")
+	op.SetTag("bucket_name", "objcheck-us-east-1")
+	ext.HTTPStatusCode.Set(op, 503)
+	op.SetTag("error", true)
+	op.LogFields(log.String("errors", "ServiceUnavailable"))
+	late := tracer.StartSpan("read_body", opentracing.ChildOf(op.Context()))
+	op.Finish()
+
+	out := http.Header{}
+	if err := xrayport.W3C.Inject(tracer, op.Context(), out); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !strings.HasPrefix(out.Get("traceparent"), "00-5759e988bd862e3fe1be46a994272793-") {
+		t.Errorf("Unexpected traceparent %v", out.Get("traceparent"))
+	}
+
+	root.Finish()
+	late.Finish()
+
+	read := func() map[string]interface{} {
+		buf := make([]byte, 65536)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		lines := strings.SplitN(string(buf[:n]), "\n", 2)
+		if len(lines) != 2 || lines[0] != `{"format": "json", "version": 1}` {
+			t.Fatalf("Unexpected packet %s", buf[:n])
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[1]), &doc); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		return doc
+	}
+
+	segment := read()
+	if segment["trace_id"] != "1-5759e988-bd862e3fe1be46a994272793" || segment["parent_id"] != "53995c3f42cd8ad8" || segment["name"] != "ObjCheck" {
+		t.Errorf("Unexpected segment %v", segment)
+	}
+	annotations, _ := segment["annotations"].(map[string]interface{})
+	if annotations["version"] != "v1" || annotations["service"] != "s3" {
+		t.Errorf("Unexpected annotations %v", annotations)
+	}
+	subsegments, _ := segment["subsegments"].([]interface{})
+	if len(subsegments) != 1 {
+		t.Fatalf("Unexpected subsegments %v", subsegments)
+	}
+	sub := subsegments[0].(map[string]interface{})
+	aws, _ := sub["aws"].(map[string]interface{})
+	if sub["namespace"] != "aws" || sub["fault"] != true || aws["operation"] != "GetObject" || aws["request_id"] != "req-1" || aws["bucket_name"] != "objcheck-us-east-1" {
+		t.Errorf("Unexpected subsegment %v", sub)
+	}
+	if sub["cause"] == nil || sub["http"].(map[string]interface{})["response"].(map[string]interface{})["status"] != float64(503) {
+		t.Errorf("Unexpected subsegment %v", sub)
+	}
+	inProgress := sub["subsegments"].([]interface{})[0].(map[string]interface{})
+	if inProgress["in_progress"] != true {
+		t.Errorf("Unfinished span wasn't in progress %v", inProgress)
+	}
+
+	independent := read()
+	if independent["type"] != "subsegment" || independent["id"] != inProgress["id"] || independent["parent_id"] != sub["id"] || independent["end_time"] == nil {
+		t.Errorf("Unexpected independent subsegment %v", independent)
+	}
+}
+
+func TestXRayTracerTruncates(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer conn.Close()
+
+	tracer, err := xrayport.NewTracer(xrayport.TracerOptions{DaemonAddress: conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer tracer.Close()
+
+	header := http.Header{"X-Amzn-Trace-Id": {"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"}}
+	parent, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	big := strings.Repeat("x", 70*1024)
+	root := tracer.StartSpan("ObjCheck", ext.RPCServerOption(parent))
+	root.SetTag("service", "s3")
+	root.LogFields(log.String("event", big))
+	root.LogFields(log.String("errors", big))
+	op := tracer.StartSpan("s3", opentracing.ChildOf(root.Context()))
+	op.Finish()
+	root.Finish()
+
+	docs := map[string]map[string]interface{}{}
+	for i := 0; i < 2; i++ {
+		buf := make([]byte, 128*1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if n > 64*1024 {
+			t.Errorf("Packet too big %d", n)
+		}
+		lines := strings.SplitN(string(buf[:n]), "\n", 2)
+		var doc map[string]interface{}
+		if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &doc) != nil {
+			t.Fatalf("Unexpected packet %.200s", buf[:n])
+		}
+		docs[doc["name"].(string)] = doc
+	}
+
+	segment := docs["ObjCheck"]
+	annotations, _ := segment["annotations"].(map[string]interface{})
+	if annotations["truncated"] != true || annotations["service"] != "s3" || segment["metadata"] != nil || segment["cause"] != nil || segment["subsegments"] != nil {
+		t.Errorf("Unexpected segment %.200v", segment)
+	}
+	if sub := docs["s3"]; sub == nil || sub["type"] != "subsegment" || sub["parent_id"] != segment["id"] {
+		t.Errorf("Unexpected subsegment %v", sub)
+	}
+}
@@ -0,0 +1,15 @@
+package xrayport_test
+
+import (
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+// useMockTracer makes a new mocktracer the global tracer, which xrayport starts its spans
+// with, until the returned func restores the previous one
+func useMockTracer() (*mocktracer.MockTracer, func()) {
+	prev := opentracing.GlobalTracer()
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	return tracer, func() { opentracing.SetGlobalTracer(prev) }
+}